@@ -0,0 +1,408 @@
+package tlsguard
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Supported cloud provider names for IP range feeds.
+const (
+	ProviderAWS          string = "aws"
+	ProviderGCP          string = "gcp"
+	ProviderAzure        string = "azure"
+	ProviderCloudflare   string = "cloudflare"
+	ProviderGitHub       string = "github"
+	ProviderFastly       string = "fastly"
+	providerFetchTimeout        = 30 * time.Second
+	providerMaxBodySize         = 32 << 20 // the Azure service tags are several MiB
+)
+
+// providerDefaultURLs holds the published feed locations. Azure publishes its
+// service tags under a weekly changing URL, so it has to be configured explicitly.
+var providerDefaultURLs = map[string]string{
+	ProviderAWS:        "https://ip-ranges.amazonaws.com/ip-ranges.json",
+	ProviderGCP:        "https://www.gstatic.com/ipranges/cloud.json",
+	ProviderCloudflare: "https://api.cloudflare.com/client/v4/ips",
+	ProviderGitHub:     "https://api.github.com/meta",
+	ProviderFastly:     "https://api.fastly.com/public-ip-list",
+}
+
+// IPRangeProvider selects IP ranges from a cloud provider's published feed.
+type IPRangeProvider struct {
+	Name            string   `json:"name"`
+	URL             string   `json:"url,omitempty"` // overrides the default feed location, file:// is supported
+	Services        []string `json:"services,omitempty"`
+	Regions         []string `json:"regions,omitempty"`
+	RefreshInterval string   `json:"refreshInterval,omitempty"` // defaults to the global refreshInterval
+}
+
+// providerFeed is a downloaded feed with its cache validators. The mutex
+// serializes fetches of the same URL.
+type providerFeed struct {
+	mutex      sync.Mutex
+	body       []byte // nil until the first successful fetch
+	fetchedAt  time.Time
+	validators fetchValidators
+}
+
+// providerFeeds caches the feeds per URL across rule rebuilds, so that a
+// rebuild does not download the feeds again. The lock only guards the map,
+// fetches hold the lock of their feed.
+var providerFeeds = struct {
+	sync.Mutex
+	feeds map[string]*providerFeed
+}{feeds: make(map[string]*providerFeed)}
+
+// refreshInterval returns the interval after which the feed is fetched again,
+// zero if it is only fetched once.
+func (p IPRangeProvider) refreshInterval() (time.Duration, error) {
+	if p.RefreshInterval == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(p.RefreshInterval)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing refresh interval of provider %s: %w", p.Name, err)
+	}
+	return duration, nil
+}
+
+// fetchRanges loads the provider feed and returns the filtered CIDR ranges.
+func (p IPRangeProvider) fetchRanges() ([]string, error) {
+	url := p.URL
+	if url == "" {
+		url = providerDefaultURLs[p.Name]
+	}
+	if url == "" {
+		return nil, fmt.Errorf("no url configured for provider %s", p.Name)
+	}
+	interval, err := p.refreshInterval()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := fetchProviderFeed(url, interval)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching ranges of provider %s: %w", p.Name, err)
+	}
+
+	return parseProviderRanges(p.Name, data, p.Services, p.Regions)
+}
+
+// fetchProviderFeed returns a cached feed until the interval has passed, then
+// fetches it again with a conditional request. If the feed cannot be fetched,
+// the cached feed is used.
+func fetchProviderFeed(url string, interval time.Duration) ([]byte, error) {
+	if filename, ok := fileSourcePath(url); ok {
+		return readProviderFile(filename)
+	}
+
+	providerFeeds.Lock()
+	feed, ok := providerFeeds.feeds[url]
+	if !ok {
+		feed = &providerFeed{}
+		providerFeeds.feeds[url] = feed
+	}
+	providerFeeds.Unlock()
+
+	feed.mutex.Lock()
+	defer feed.mutex.Unlock()
+
+	cached := feed.body != nil
+	if cached && (interval == 0 || time.Since(feed.fetchedAt) < interval) {
+		return feed.body, nil
+	}
+
+	validators := feed.validators
+	body, err := fetchProviderData(url, &validators)
+	switch {
+	case errors.Is(err, errNotModified) && cached:
+		feed.fetchedAt = time.Now()
+		return feed.body, nil
+	case err != nil && cached:
+		fmt.Printf("Error fetching %s, keeping previous ranges: %v\n", url, err)
+		return feed.body, nil
+	case err != nil:
+		return nil, err
+	}
+	feed.body = body
+	feed.fetchedAt = time.Now()
+	feed.validators = validators
+	return body, nil
+}
+
+// readProviderFile reads a local feed with the size limit of downloaded feeds.
+func readProviderFile(filename string) ([]byte, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return readProviderBody(file)
+}
+
+// readProviderBody reads a feed and rejects feeds above providerMaxBodySize.
+func readProviderBody(reader io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(reader, providerMaxBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > providerMaxBodySize {
+		return nil, fmt.Errorf("feed exceeds %d bytes", providerMaxBodySize)
+	}
+	return data, nil
+}
+
+// fetchProviderData downloads a feed. With validators the request is
+// conditional and errNotModified reports an unchanged feed; the validators are
+// updated from the response.
+func fetchProviderData(url string, validators *fetchValidators) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if validators != nil {
+		if validators.ETag != "" {
+			req.Header.Set("If-None-Match", validators.ETag)
+		}
+		if validators.LastModified != "" {
+			req.Header.Set("If-Modified-Since", validators.LastModified)
+		}
+	}
+
+	client := &http.Client{Timeout: providerFetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode == http.StatusNotModified && validators != nil {
+		return nil, errNotModified
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	data, err := readProviderBody(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if validators != nil {
+		validators.ETag = resp.Header.Get("ETag")
+		validators.LastModified = resp.Header.Get("Last-Modified")
+	}
+	return data, nil
+}
+
+// parseProviderRanges parses a provider feed and applies service and region filters.
+func parseProviderRanges(name string, data []byte, services, regions []string) ([]string, error) {
+	switch name {
+	case ProviderAWS:
+		return parseAWSRanges(data, services, regions)
+	case ProviderGCP:
+		return parseGCPRanges(data, services, regions)
+	case ProviderAzure:
+		return parseAzureRanges(data, services, regions)
+	case ProviderCloudflare:
+		if len(services) > 0 || len(regions) > 0 {
+			return nil, fmt.Errorf("provider %s does not support service or region filters", name)
+		}
+		return parseCloudflareRanges(data)
+	case ProviderGitHub:
+		if len(regions) > 0 {
+			return nil, fmt.Errorf("provider %s does not support region filters", name)
+		}
+		return parseGitHubRanges(data, services)
+	case ProviderFastly:
+		if len(services) > 0 || len(regions) > 0 {
+			return nil, fmt.Errorf("provider %s does not support service or region filters", name)
+		}
+		return parseFastlyRanges(data)
+	default:
+		return nil, fmt.Errorf("unknown ip range provider: %s", name)
+	}
+}
+
+// parseAWSRanges parses https://ip-ranges.amazonaws.com/ip-ranges.json.
+func parseAWSRanges(data []byte, services, regions []string) ([]string, error) {
+	var feed struct {
+		Prefixes []struct {
+			IPPrefix string `json:"ip_prefix"`
+			Region   string `json:"region"`
+			Service  string `json:"service"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			IPv6Prefix string `json:"ipv6_prefix"`
+			Region     string `json:"region"`
+			Service    string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}
+	err := json.Unmarshal(data, &feed)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing aws ranges: %w", err)
+	}
+
+	var ranges []string
+	for _, prefix := range feed.Prefixes {
+		if matchesFilter(services, prefix.Service) && matchesFilter(regions, prefix.Region) {
+			ranges = append(ranges, prefix.IPPrefix)
+		}
+	}
+	for _, prefix := range feed.IPv6Prefixes {
+		if matchesFilter(services, prefix.Service) && matchesFilter(regions, prefix.Region) {
+			ranges = append(ranges, prefix.IPv6Prefix)
+		}
+	}
+	return ranges, nil
+}
+
+// parseGCPRanges parses https://www.gstatic.com/ipranges/cloud.json.
+func parseGCPRanges(data []byte, services, regions []string) ([]string, error) {
+	var feed struct {
+		Prefixes []struct {
+			IPv4Prefix string `json:"ipv4Prefix"`
+			IPv6Prefix string `json:"ipv6Prefix"`
+			Service    string `json:"service"`
+			Scope      string `json:"scope"`
+		} `json:"prefixes"`
+	}
+	err := json.Unmarshal(data, &feed)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing gcp ranges: %w", err)
+	}
+
+	var ranges []string
+	for _, prefix := range feed.Prefixes {
+		if !matchesFilter(services, prefix.Service) || !matchesFilter(regions, prefix.Scope) {
+			continue
+		}
+		if prefix.IPv4Prefix != "" {
+			ranges = append(ranges, prefix.IPv4Prefix)
+		}
+		if prefix.IPv6Prefix != "" {
+			ranges = append(ranges, prefix.IPv6Prefix)
+		}
+	}
+	return ranges, nil
+}
+
+// parseAzureRanges parses the Azure service tags file (ServiceTags_Public_*.json).
+// Services match either the service tag name (e.g. AzureFrontDoor.Frontend) or the system service.
+func parseAzureRanges(data []byte, services, regions []string) ([]string, error) {
+	var feed struct {
+		Values []struct {
+			Name       string `json:"name"`
+			Properties struct {
+				Region          string   `json:"region"`
+				SystemService   string   `json:"systemService"`
+				AddressPrefixes []string `json:"addressPrefixes"`
+			} `json:"properties"`
+		} `json:"values"`
+	}
+	err := json.Unmarshal(data, &feed)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing azure ranges: %w", err)
+	}
+
+	var ranges []string
+	for _, value := range feed.Values {
+		if !matchesFilter(services, value.Name, value.Properties.SystemService) ||
+			!matchesFilter(regions, value.Properties.Region) {
+			continue
+		}
+		ranges = append(ranges, value.Properties.AddressPrefixes...)
+	}
+	return ranges, nil
+}
+
+// parseCloudflareRanges parses https://api.cloudflare.com/client/v4/ips.
+func parseCloudflareRanges(data []byte) ([]string, error) {
+	var feed struct {
+		Result struct {
+			IPv4Cidrs []string `json:"ipv4_cidrs"`
+			IPv6Cidrs []string `json:"ipv6_cidrs"`
+		} `json:"result"`
+	}
+	err := json.Unmarshal(data, &feed)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing cloudflare ranges: %w", err)
+	}
+
+	return append(feed.Result.IPv4Cidrs, feed.Result.IPv6Cidrs...), nil
+}
+
+// parseGitHubRanges parses https://api.github.com/meta. Services select the
+// top-level lists (e.g. actions, hooks, web); without a filter all lists are used.
+func parseGitHubRanges(data []byte, services []string) ([]string, error) {
+	var feed map[string]json.RawMessage
+	err := json.Unmarshal(data, &feed)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing github ranges: %w", err)
+	}
+
+	keys := make([]string, 0, len(feed))
+	for key := range feed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var ranges []string
+	for _, key := range keys {
+		if !matchesFilter(services, key) {
+			continue
+		}
+		var values []string
+		if json.Unmarshal(feed[key], &values) != nil {
+			// Not a list of ranges (e.g. verifiable_password_authentication or domains)
+			continue
+		}
+		for _, value := range values {
+			if strings.Contains(value, "/") {
+				ranges = append(ranges, value)
+			}
+		}
+	}
+	return ranges, nil
+}
+
+// parseFastlyRanges parses https://api.fastly.com/public-ip-list.
+func parseFastlyRanges(data []byte) ([]string, error) {
+	var feed struct {
+		Addresses     []string `json:"addresses"`
+		IPv6Addresses []string `json:"ipv6_addresses"`
+	}
+	err := json.Unmarshal(data, &feed)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing fastly ranges: %w", err)
+	}
+
+	return append(feed.Addresses, feed.IPv6Addresses...), nil
+}
+
+// matchesFilter reports whether any of the values is in the filter, ignoring case.
+// An empty filter matches everything.
+func matchesFilter(filter []string, values ...string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, allowed := range filter {
+		for _, value := range values {
+			if strings.EqualFold(allowed, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,328 @@
+package tlsguard
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func providerFixtureURL(t *testing.T, name string) string {
+	t.Helper()
+	path, err := filepath.Abs(filepath.Join("testdata", "providers", name+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "file://" + path
+}
+
+func TestProviderRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider string
+		services []string
+		regions  []string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "aws all",
+			provider: ProviderAWS,
+			want: []string{
+				"3.5.140.0/22", "13.32.0.0/15", "52.46.0.0/18", "52.94.0.0/22", "18.34.0.0/19",
+				"2600:9000:f000::/36", "2600:1f14::/35",
+			},
+		},
+		{
+			name:     "aws cloudfront in us-east-1",
+			provider: ProviderAWS,
+			services: []string{"CLOUDFRONT"},
+			regions:  []string{"us-east-1"},
+			want:     []string{"52.46.0.0/18", "2600:9000:f000::/36"},
+		},
+		{
+			name:     "aws filters ignore case",
+			provider: ProviderAWS,
+			services: []string{"cloudfront"},
+			regions:  []string{"global"},
+			want:     []string{"13.32.0.0/15"},
+		},
+		{
+			name:     "aws several services",
+			provider: ProviderAWS,
+			services: []string{"EC2", "AMAZON"},
+			regions:  []string{"us-west-2", "ap-northeast-2"},
+			want:     []string{"3.5.140.0/22", "18.34.0.0/19", "2600:1f14::/35"},
+		},
+		{
+			name:     "aws no match",
+			provider: ProviderAWS,
+			services: []string{"S3"},
+		},
+		{
+			name:     "gcp region",
+			provider: ProviderGCP,
+			regions:  []string{"africa-south1"},
+			want:     []string{"34.35.0.0/16", "2600:1900:8000::/44"},
+		},
+		{
+			name:     "gcp service",
+			provider: ProviderGCP,
+			services: []string{"Google Cloud"},
+			regions:  []string{"europe-west1", "asia-east1"},
+			want:     []string{"34.80.0.0/15", "35.185.128.0/19"},
+		},
+		{
+			name:     "azure service tag",
+			provider: ProviderAzure,
+			services: []string{"AzureFrontDoor.Frontend"},
+			want:     []string{"13.107.246.0/24", "2620:1ec:bdf::/48"},
+		},
+		{
+			name:     "azure system service and region",
+			provider: ProviderAzure,
+			services: []string{"AzureStorage"},
+			regions:  []string{"westeurope"},
+			want:     []string{"20.38.108.0/23"},
+		},
+		{
+			name:     "azure region",
+			provider: ProviderAzure,
+			regions:  []string{"westeurope"},
+			want:     []string{"13.69.0.0/17", "20.50.0.0/18", "20.38.108.0/23"},
+		},
+		{
+			name:     "cloudflare",
+			provider: ProviderCloudflare,
+			want:     []string{"173.245.48.0/20", "103.21.244.0/22", "2400:cb00::/32"},
+		},
+		{
+			name:     "cloudflare rejects filters",
+			provider: ProviderCloudflare,
+			regions:  []string{"us-east-1"},
+			wantErr:  true,
+		},
+		{
+			name:     "github all lists",
+			provider: ProviderGitHub,
+			want:     []string{"4.148.0.0/16", "192.30.252.0/22", "2a0a:a440::/29", "140.82.112.0/20"},
+		},
+		{
+			name:     "github hooks",
+			provider: ProviderGitHub,
+			services: []string{"hooks"},
+			want:     []string{"192.30.252.0/22", "2a0a:a440::/29"},
+		},
+		{
+			name:     "github rejects regions",
+			provider: ProviderGitHub,
+			regions:  []string{"us"},
+			wantErr:  true,
+		},
+		{
+			name:     "fastly",
+			provider: ProviderFastly,
+			want:     []string{"23.235.32.0/20", "151.101.0.0/16", "2a04:4e40::/32"},
+		},
+		{
+			name:     "fastly rejects services",
+			provider: ProviderFastly,
+			services: []string{"cdn"},
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider := IPRangeProvider{
+				Name:     test.provider,
+				URL:      providerFixtureURL(t, test.provider),
+				Services: test.services,
+				Regions:  test.regions,
+			}
+			got, err := provider.fetchRanges()
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestProviderRangesErrors(t *testing.T) {
+	_, err := parseProviderRanges("unknown", []byte("{}"), nil, nil)
+	if err == nil {
+		t.Error("expected an error for an unknown provider")
+	}
+	_, err = parseProviderRanges(ProviderAWS, []byte("<html>"), nil, nil)
+	if err == nil {
+		t.Error("expected an error for an invalid feed")
+	}
+	_, err = IPRangeProvider{Name: ProviderAzure}.fetchRanges()
+	if err == nil {
+		t.Error("expected an error for azure without url")
+	}
+}
+
+func TestFetchProviderData(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/ranges":
+			_, _ = io.WriteString(rw, `{"addresses": ["192.0.2.0/24"]}`)
+		case "/large":
+			_, _ = io.Copy(rw, io.LimitReader(zeroReader{}, providerMaxBodySize+1))
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	defer server.Close()
+
+	data, err := fetchProviderData(server.URL+"/ranges", nil)
+	if err != nil || !strings.Contains(string(data), "192.0.2.0/24") {
+		t.Errorf("unexpected result %q, %v", data, err)
+	}
+	_, err = fetchProviderData(server.URL+"/missing", nil)
+	if err == nil {
+		t.Error("expected an error for status 404")
+	}
+	_, err = fetchProviderData(server.URL+"/large", nil)
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("expected a size error, got %v", err)
+	}
+}
+
+func TestProviderFeedCache(t *testing.T) {
+	var requests, conditional int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&conditional, 1)
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		rw.Header().Set("ETag", `"v1"`)
+		_, _ = io.WriteString(rw, `{"addresses": ["192.0.2.0/24"]}`)
+	}))
+	defer server.Close()
+
+	newRule := func() *RuleIPRange {
+		return &RuleIPRange{Providers: []IPRangeProvider{{Name: ProviderFastly, URL: server.URL, RefreshInterval: "1h"}}}
+	}
+
+	// Rebuilding the rules uses the cached feed
+	for i := 0; i < 2; i++ {
+		err := newRule().Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("feed fetched %d times, want 1", got)
+	}
+
+	// Once the interval has passed the rule refreshes the feed conditionally
+	rule := newRule()
+	err := rule.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	providerFeeds.Lock()
+	feed := providerFeeds.feeds[server.URL]
+	providerFeeds.Unlock()
+	feed.mutex.Lock()
+	feed.fetchedAt = time.Now().Add(-2 * time.Hour)
+	feed.mutex.Unlock()
+	rule.rescanMutex.Lock()
+	rule.nextRefresh = time.Now()
+	rule.rescanMutex.Unlock()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Real-Ip", "192.0.2.1")
+	if !rule.Match(req) {
+		t.Error("IP in the provider ranges did not match")
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&conditional) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&conditional); got != 1 {
+		t.Errorf("expected 1 conditional request, got %d", got)
+	}
+	if !rule.Match(req) {
+		t.Error("unchanged feed lost the provider ranges")
+	}
+}
+
+func TestSlowProviderFeedDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+		_, _ = io.WriteString(rw, `{"addresses": ["192.0.2.0/24"]}`)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	go func() {
+		_, _ = fetchProviderFeed(server.URL+"/slow", time.Hour)
+	}()
+	<-started
+
+	done := make(chan error)
+	go func() {
+		_, err := fetchProviderFeed(server.URL+"/fast", time.Hour)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("fetching a feed waited for another feed")
+	}
+}
+
+func TestProviderFileSizeLimit(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "large.json")
+	file, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.Copy(file, io.LimitReader(zeroReader{}, providerMaxBodySize+1))
+	_ = file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = fetchProviderFeed("file://"+filename, 0)
+	if err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Errorf("expected a size error, got %v", err)
+	}
+}
+
+// zeroReader is an endless source of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -3,6 +3,7 @@ package tlsguard
 import (
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 )
@@ -12,29 +13,88 @@ type Config struct {
 	// User authentication based on certificates
 	Users          map[string]string `json:"users,omitempty"`
 	UsernameHeader string            `json:"usernameHeader,omitempty"`
-	
+
 	// Rules for IP whitelisting and other criteria
-	Rules           []RawRule         `json:"rules,omitempty"`
-	ExternalData    ExternalData      `json:"externalData,omitempty"`
-	RefreshInterval string            `json:"refreshInterval,omitempty"`
-	RequestHeaders  map[string]string `json:"requestHeaders,omitempty"`
+	Rules           []RawRule               `json:"rules,omitempty"`
+	DefaultAction   string                  `json:"defaultAction,omitempty"` // action when no rule matches, defaults to deny
+	Mode            string                  `json:"mode,omitempty"`          // enforce (default) or report
+	Definitions     map[string]RawRule      `json:"definitions,omitempty"`   // named rules referenced with the ref rule type
+	ExternalData    ExternalData            `json:"externalData,omitempty"`
+	ExternalSources map[string]ExternalData `json:"externalSources,omitempty"` // named sources available as .data.<name>
+	RefreshInterval string                  `json:"refreshInterval,omitempty"`
+	RequestHeaders  map[string]string       `json:"requestHeaders,omitempty"`
+
+	// Client certificate forwarding
+	ForwardCert ForwardCert `json:"forwardCert,omitempty"` // to the backend
+	ProxyCert   ProxyCert   `json:"proxyCert,omitempty"`   // from a TLS terminating proxy in front of Traefik
+
+	// Signed identity token for the backend
+	IdentityToken IdentityToken `json:"identityToken,omitempty"`
+
+	// Names of the informational headers
+	InfoHeaders InfoHeaders `json:"infoHeaders,omitempty"`
+
+	// Header sanitization
+	SanitizeHeaders bool     `json:"sanitizeHeaders,omitempty"` // also remove all other client-supplied X-TLSGuard-* and stripHeaders headers, enabled by default
+	StripHeaders    []string `json:"stripHeaders,omitempty"`    // additional headers to remove
+
+	// Responses to denied requests
+	DenyResponse  DenyResponse            `json:"denyResponse,omitempty"`
+	DenyResponses map[string]DenyResponse `json:"denyResponses,omitempty"` // per deny reason, replaces denyResponse
+	DenyPage      DenyPage                `json:"denyPage,omitempty"`      // HTML page for browsers
+
+	// Decision tracing
+	DebugToken   string `json:"debugToken,omitempty"`   // requests presenting it in X-TLSGuard-Debug receive the X-TLSGuard-Trace header
+	LogDecisions bool   `json:"logDecisions,omitempty"` // log every decision with its trace
 }
 
 // ExternalData defines an external data source for rules.
 type ExternalData struct {
-	URL           string            `json:"url"`
-	Headers       map[string]string `json:"headers,omitempty"`
-	DataKey       string            `json:"dataKey,omitempty"` // if the data is nested in the response, specify the key here
-	SkipTLSVerify bool              `json:"skipTlsVerify,omitempty"`
+	URL           string                `json:"url"` // http(s) URL, or file:// for a local file or directory
+	Headers       map[string]string     `json:"headers,omitempty"`
+	Method        string                `json:"method,omitempty"` // defaults to GET, or POST for graphql
+	Body          string                `json:"body,omitempty"`   // templated request body
+	GraphQL       GraphQL               `json:"graphql,omitempty"`
+	DataKey       string                `json:"dataKey,omitempty"`  // if the data is nested in the response, specify the key here
+	DataPath      string                `json:"dataPath,omitempty"` // path like $.result.networks[*].cidr, instead of dataKey
+	Format        string                `json:"format,omitempty"`   // json (default), yaml, csv or lines
+	CSV           CSVOptions            `json:"csv,omitempty"`
+	CAFile        string                `json:"caFile,omitempty"`        // CA to verify the server, PEM data or file name, templated
+	CertFile      string                `json:"certFile,omitempty"`      // client certificate for mutual TLS, like caFile
+	KeyFile       string                `json:"keyFile,omitempty"`       // key of the client certificate, like caFile
+	ServerName    string                `json:"serverName,omitempty"`    // overrides the name verified in the server certificate
+	SkipTLSVerify bool                  `json:"skipTlsVerify,omitempty"` // deprecated, use caFile
+	OAuth2        OAuth2                `json:"oauth2,omitempty"`        // client credentials flow for the Authorization header
+	Signature     SignatureVerification `json:"signature,omitempty"`     // verify the data against a pinned public key
+	Timeout       string                `json:"timeout,omitempty"`       // request timeout, defaults to 30s
+	MaxBodySize   int64                 `json:"maxBodySize,omitempty"`   // bytes, defaults to 10 MiB
+	Retries       int                   `json:"retries,omitempty"`       // retries of failed requests, defaults to 2
+	RetryDelay    string                `json:"retryDelay,omitempty"`    // first backoff delay, doubled per retry, defaults to 1s
+
+	RefreshInterval string `json:"refreshInterval,omitempty"` // overrides the global refreshInterval for this source
+	CacheFile       string `json:"cacheFile,omitempty"`       // last successful response, used if the source is down at startup
+	PollInterval    string `json:"pollInterval,omitempty"`    // how often file:// sources are checked for changes
 }
 
 // RawRule defines a rule in the configuration.
 type RawRule struct {
-	Type         string            `json:"type"`
-	Headers      map[string]string `json:"headers,omitempty"`
-	Ranges       []string          `json:"ranges,omitempty"`
-	AddInterface bool              `json:"addInterface,omitempty"`
-	Rules        []RawRule         `json:"rules,omitempty"`
+	Type          string            `json:"type"`
+	Action        string            `json:"action,omitempty"` // allow or deny, only for top-level rules
+	Mode          string            `json:"mode,omitempty"`   // enforce or report, only for top-level rules
+	Ref           string            `json:"ref,omitempty"`    // name of a rule definition
+	Expr          string            `json:"expr,omitempty"`
+	Source        string            `json:"source,omitempty"` // external source of a dataFresh rule
+	MaxAge        string            `json:"maxAge,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Ranges        []string          `json:"ranges,omitempty"`
+	Providers     []IPRangeProvider `json:"providers,omitempty"`
+	AddInterface  bool              `json:"addInterface,omitempty"`
+	Interfaces    []string          `json:"interfaces,omitempty"`
+	AllInterfaces bool              `json:"allInterfaces,omitempty"`
+	ProcRoot      string            `json:"procRoot,omitempty"`
+	Rules         []RawRule         `json:"rules,omitempty"`
+
+	InterfaceRefreshInterval string `json:"interfaceRefreshInterval,omitempty"`
 }
 
 // Define rule type constants
@@ -44,6 +104,22 @@ const (
 	NoneOf  string = "noneOf"
 	IPRange string = "ipRange"
 	Header  string = "header"
+	Ref     string = "ref"
+	Expr    string = "expr"
+
+	DataFresh string = "dataFresh"
+)
+
+// Define rule action constants
+const (
+	ActionAllow string = "allow"
+	ActionDeny  string = "deny"
+)
+
+// Define mode constants
+const (
+	ModeEnforce string = "enforce"
+	ModeReport  string = "report"
 )
 
 // Rule interface for all rule types
@@ -52,52 +128,145 @@ type Rule interface {
 	Match(req *http.Request) bool
 }
 
+// PolicyRule is a top-level rule with the action taken when it matches.
+type PolicyRule struct {
+	Rule   Rule   `json:"rule"`
+	Action string `json:"action"`
+	Mode   string `json:"mode"`
+}
+
+// Decision is the result of evaluating the rules.
+type Decision struct {
+	Allowed   bool
+	Reason    string
+	WouldDeny string // reason of a report-only rule that would have denied the request
+}
+
 // RuleConfig holds the processed rules
 type RuleConfig struct {
-	CreationTime time.Time
-	NextUpdate   *time.Time
-	Rules        []Rule `json:"rules"`
+	CreationTime  time.Time
+	NextUpdate    *time.Time
+	Rules         []PolicyRule `json:"rules"`
+	DefaultAction string       `json:"defaultAction"`
+
+	// Internal
+	dataVersion int // version of the external data the rules were built from
 }
 
 // NewRuleConfig creates a new rule configuration from raw config.
-func NewRuleConfig(config *Config) (*RuleConfig, error) {
+// The store provides the external data; it may be nil.
+func NewRuleConfig(config *Config, store *externalDataStore) (*RuleConfig, error) {
 	ruleConfig := &RuleConfig{}
 	tmplData := make(map[string]interface{})
 
-	if config.ExternalData.URL != "" {
-		data, err := GetExternalData(config.ExternalData)
+	if store != nil {
+		data, version, err := store.templateData()
 		if err != nil {
 			return nil, err
 		}
-		tmplData["data"] = data[config.ExternalData.DataKey]
+		tmplData["data"] = data
+		ruleConfig.dataVersion = version
 	}
-	fmt.Printf("external data: %v\n", tmplData)
 
-	rules, err := mapRules(tmplData, config.Rules)
+	mapper := &ruleMapper{tmplData: tmplData, store: store, refreshInterval: config.RefreshInterval, definitions: config.Definitions}
+	err := mapper.checkDefinitions()
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := mapper.mapRules(config.Rules)
 	if err != nil {
 		return nil, err
 	}
 	ruleConfig.CreationTime = time.Now()
-	ruleConfig.Rules = rules
+	ruleConfig.Rules = make([]PolicyRule, 0, len(rules))
+	for i, rule := range rules {
+		action, err := parseAction(config.Rules[i].Action, ActionAllow)
+		if err != nil {
+			return nil, err
+		}
+		mode := config.Rules[i].Mode
+		if mode == "" {
+			mode = ModeEnforce
+		} else if mode != ModeEnforce && mode != ModeReport {
+			return nil, fmt.Errorf("unknown rule mode: %s", mode)
+		}
+		err = checkNestedActions(config.Rules[i].Rules)
+		if err != nil {
+			return nil, err
+		}
+		ruleConfig.Rules = append(ruleConfig.Rules, PolicyRule{Rule: rule, Action: action, Mode: mode})
+	}
 
+	ruleConfig.DefaultAction, err = parseAction(config.DefaultAction, ActionDeny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default action: %w", err)
+	}
+
+	err = ruleConfig.scheduleUpdate(config, store, ruleConfig.CreationTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return ruleConfig, nil
+}
+
+// scheduleUpdate sets the next update from the refresh interval and the
+// intervals of the external sources.
+func (c *RuleConfig) scheduleUpdate(config *Config, store *externalDataStore, now time.Time) error {
+	c.NextUpdate = nil
 	if config.RefreshInterval != "" {
 		duration, err := time.ParseDuration(config.RefreshInterval)
 		if err != nil {
-			return nil, fmt.Errorf("error parsing refresh interval: %w", err)
+			return fmt.Errorf("error parsing refresh interval: %w", err)
 		}
-		nextUpdate := ruleConfig.CreationTime.Add(duration)
-		ruleConfig.NextUpdate = &nextUpdate
-	} else {
-		ruleConfig.NextUpdate = nil
+		nextUpdate := now.Add(duration)
+		c.NextUpdate = &nextUpdate
 	}
 
-	return ruleConfig, nil
+	// Sources with their own refresh interval may be due earlier
+	if store != nil {
+		sourceUpdate := store.nextUpdate()
+		if sourceUpdate != nil && (c.NextUpdate == nil || sourceUpdate.Before(*c.NextUpdate)) {
+			c.NextUpdate = sourceUpdate
+		}
+	}
+	return nil
+}
+
+// parseAction validates a rule action and falls back to the default if empty.
+func parseAction(action string, defaultAction string) (string, error) {
+	switch action {
+	case "":
+		return defaultAction, nil
+	case ActionAllow, ActionDeny:
+		return action, nil
+	default:
+		return "", fmt.Errorf("unknown rule action: %s", action)
+	}
+}
+
+// checkNestedActions rejects actions below the top-level rules.
+func checkNestedActions(rawRules []RawRule) error {
+	for _, rawRule := range rawRules {
+		if rawRule.Action != "" {
+			return fmt.Errorf("action %s is only supported on top-level rules", rawRule.Action)
+		}
+		if rawRule.Mode != "" {
+			return fmt.Errorf("mode %s is only supported on top-level rules", rawRule.Mode)
+		}
+		err := checkNestedActions(rawRule.Rules)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Init initializes all rules.
 func (c *RuleConfig) Init() error {
 	for _, rule := range c.Rules {
-		err := rule.Init()
+		err := rule.Rule.Init()
 		if err != nil {
 			return err
 		}
@@ -105,25 +274,113 @@ func (c *RuleConfig) Init() error {
 	return nil
 }
 
-// Match checks if any rule matches the request.
+// Match checks if the rules allow the request.
 func (c *RuleConfig) Match(req *http.Request) bool {
-	for _, rule := range c.Rules {
-		if rule.Match(req) {
-			return true
+	return c.Evaluate(req, nil).Allowed
+}
+
+// Evaluate evaluates the rules in order; the action of the first matching rule
+// decides. If no rule matches, the default action applies. Rules in report mode
+// never decide; a matching report-only deny rule is returned as WouldDeny.
+func (c *RuleConfig) Evaluate(req *http.Request, trace *Trace) Decision {
+	decision := Decision{}
+	for i, rule := range c.Rules {
+		path := trace.subPath("", i)
+		if !matchRule(rule.Rule, req, trace, path) {
+			continue
+		}
+		if rule.Mode == ModeReport {
+			trace.addf(path, traceTypeMode, true, "report mode, would %s", rule.Action)
+			if rule.Action == ActionDeny && decision.WouldDeny == "" {
+				decision.WouldDeny = fmt.Sprintf("rules[%d] matched", i)
+			}
+			continue
 		}
+		decision.Allowed = rule.Action == ActionAllow
+		decision.Reason = fmt.Sprintf("rules[%d] matched", i)
+		trace.decide(rule.Action, decision.Reason)
+		return decision
 	}
-	return false
+	decision.Allowed = c.DefaultAction == ActionAllow
+	decision.Reason = "no rule matched, default action"
+	trace.decide(c.DefaultAction, decision.Reason)
+	return decision
+}
+
+// ruleMapper converts raw rules to processed rules.
+type ruleMapper struct {
+	tmplData        map[string]interface{}
+	store           *externalDataStore
+	refreshInterval string // default refresh of data that rules fetch themselves
+	definitions     map[string]RawRule
+	resolving       []string // definitions currently being resolved, for cycle detection
+}
+
+// checkDefinitions resolves every definition once so that unknown references,
+// cycles and invalid rules are reported even if a definition is not used.
+func (m *ruleMapper) checkDefinitions() error {
+	names := make([]string, 0, len(m.definitions))
+	for name, definition := range m.definitions {
+		if definition.Action != "" || definition.Mode != "" {
+			return fmt.Errorf("rule definition %s: action and mode are only supported on top-level rules", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		_, err := m.resolveRef(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveRef maps the named rule definition.
+func (m *ruleMapper) resolveRef(name string) (Rule, error) {
+	for i, resolving := range m.resolving {
+		if resolving == name {
+			cycle := append(append([]string{}, m.resolving[i:]...), name)
+			return nil, fmt.Errorf("cyclic rule reference: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	definition, ok := m.definitions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown rule definition: %s", name)
+	}
+	err := checkNestedActions(definition.Rules)
+	if err != nil {
+		return nil, fmt.Errorf("rule definition %s: %w", name, err)
+	}
+
+	m.resolving = append(m.resolving, name)
+	defer func() {
+		m.resolving = m.resolving[:len(m.resolving)-1]
+	}()
+
+	rules, err := m.mapRules([]RawRule{definition})
+	if err != nil {
+		return nil, fmt.Errorf("error mapping rule definition %s: %w", name, err)
+	}
+	return &RuleRef{Name: name, Rule: rules[0]}, nil
 }
 
 // mapRules converts raw rules to processed rules.
-func mapRules(tmplData map[string]interface{}, rawRules []RawRule) ([]Rule, error) {
+func (m *ruleMapper) mapRules(rawRules []RawRule) ([]Rule, error) {
+	tmplData := m.tmplData
 	rules := make([]Rule, 0, len(rawRules))
 	for _, rawRule := range rawRules {
+		if rawRule.Type == "" && rawRule.Ref != "" {
+			rawRule.Type = Ref
+		}
+
 		var rule Rule
 		switch rawRule.Type {
 		case AllOf:
 			rrule := &RuleAllOf{}
-			allOfRules, err := mapRules(tmplData, rawRule.Rules)
+			allOfRules, err := m.mapRules(rawRule.Rules)
 			if err != nil {
 				return nil, fmt.Errorf("error mapping rules: %w", err)
 			}
@@ -131,7 +388,7 @@ func mapRules(tmplData map[string]interface{}, rawRules []RawRule) ([]Rule, erro
 			rule = rrule
 		case AnyOf:
 			rrule := &RuleAnyOf{}
-			anyOfRules, err := mapRules(tmplData, rawRule.Rules)
+			anyOfRules, err := m.mapRules(rawRule.Rules)
 			if err != nil {
 				return nil, fmt.Errorf("error mapping rules: %w", err)
 			}
@@ -139,7 +396,7 @@ func mapRules(tmplData map[string]interface{}, rawRules []RawRule) ([]Rule, erro
 			rule = rrule
 		case NoneOf:
 			rrule := &RuleNoneOf{}
-			noneOfRules, err := mapRules(tmplData, rawRule.Rules)
+			noneOfRules, err := m.mapRules(rawRule.Rules)
 			if err != nil {
 				return nil, fmt.Errorf("error mapping rules: %w", err)
 			}
@@ -167,7 +424,21 @@ func mapRules(tmplData map[string]interface{}, rawRules []RawRule) ([]Rule, erro
 					}
 				}
 			}
+			rrule.Providers = make([]IPRangeProvider, 0, len(rawRule.Providers))
+			for _, provider := range rawRule.Providers {
+				if provider.RefreshInterval == "" {
+					provider.RefreshInterval = m.refreshInterval
+				}
+				rrule.Providers = append(rrule.Providers, provider)
+			}
 			rrule.AddInterface = rawRule.AddInterface
+			rrule.Interfaces = rawRule.Interfaces
+			rrule.AllInterfaces = rawRule.AllInterfaces
+			rrule.ProcRoot = rawRule.ProcRoot
+			rrule.InterfaceRefreshInterval = rawRule.InterfaceRefreshInterval
+			if rrule.InterfaceRefreshInterval == "" && rrule.interfaceOptions().enabled() {
+				rrule.InterfaceRefreshInterval = m.refreshInterval
+			}
 			rule = rrule
 		case Header:
 			rrule := &RuleHeader{}
@@ -180,6 +451,16 @@ func mapRules(tmplData map[string]interface{}, rawRules []RawRule) ([]Rule, erro
 				rrule.Headers[key] = val
 			}
 			rule = rrule
+		case Expr:
+			rule = &RuleExpr{Expr: rawRule.Expr, Data: tmplData["data"], store: m.store}
+		case DataFresh:
+			rule = &RuleDataFresh{Source: rawRule.Source, MaxAge: rawRule.MaxAge, store: m.store}
+		case Ref:
+			rrule, err := m.resolveRef(rawRule.Ref)
+			if err != nil {
+				return nil, err
+			}
+			rule = rrule
 		default:
 			return nil, fmt.Errorf("unknown rule type: %s", rawRule.Type)
 		}
@@ -204,11 +485,18 @@ func (r *RuleAllOf) Init() error {
 }
 
 func (r *RuleAllOf) Match(req *http.Request) bool {
-	for _, rule := range r.Rules {
-		if !rule.Match(req) {
+	return r.MatchTrace(req, nil, "")
+}
+
+func (r *RuleAllOf) MatchTrace(req *http.Request, trace *Trace, path string) bool {
+	for i, rule := range r.Rules {
+		rulePath := trace.subPath(path, i)
+		if !matchRule(rule, req, trace, rulePath) {
+			trace.addf(path, AllOf, false, "%s did not match", rulePath)
 			return false
 		}
 	}
+	trace.addf(path, AllOf, true, "all %d subrules matched", len(r.Rules))
 	return true
 }
 
@@ -228,11 +516,18 @@ func (r *RuleAnyOf) Init() error {
 }
 
 func (r *RuleAnyOf) Match(req *http.Request) bool {
-	for _, rule := range r.Rules {
-		if rule.Match(req) {
+	return r.MatchTrace(req, nil, "")
+}
+
+func (r *RuleAnyOf) MatchTrace(req *http.Request, trace *Trace, path string) bool {
+	for i, rule := range r.Rules {
+		rulePath := trace.subPath(path, i)
+		if matchRule(rule, req, trace, rulePath) {
+			trace.addf(path, AnyOf, true, "%s matched", rulePath)
 			return true
 		}
 	}
+	trace.addf(path, AnyOf, false, "none of %d subrules matched", len(r.Rules))
 	return false
 }
 
@@ -252,10 +547,41 @@ func (r *RuleNoneOf) Init() error {
 }
 
 func (r *RuleNoneOf) Match(req *http.Request) bool {
-	for _, rule := range r.Rules {
-		if rule.Match(req) {
+	return r.MatchTrace(req, nil, "")
+}
+
+func (r *RuleNoneOf) MatchTrace(req *http.Request, trace *Trace, path string) bool {
+	for i, rule := range r.Rules {
+		rulePath := trace.subPath(path, i)
+		if matchRule(rule, req, trace, rulePath) {
+			trace.addf(path, NoneOf, false, "%s matched", rulePath)
 			return false
 		}
 	}
+	trace.addf(path, NoneOf, true, "none of %d subrules matched", len(r.Rules))
 	return true
-}
\ No newline at end of file
+}
+
+// RuleRef implements a rule that evaluates a named rule definition.
+type RuleRef struct {
+	Name string `json:"ref"`
+	Rule Rule   `json:"rule"`
+}
+
+func (r *RuleRef) Init() error {
+	return r.Rule.Init()
+}
+
+func (r *RuleRef) Match(req *http.Request) bool {
+	return r.MatchTrace(req, nil, "")
+}
+
+func (r *RuleRef) MatchTrace(req *http.Request, trace *Trace, path string) bool {
+	rulePath := ""
+	if trace != nil {
+		rulePath = fmt.Sprintf("%s.ref[%s]", path, r.Name)
+	}
+	matched := matchRule(r.Rule, req, trace, rulePath)
+	trace.addf(path, Ref, matched, "definition %s", r.Name)
+	return matched
+}
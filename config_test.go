@@ -0,0 +1,213 @@
+package tlsguard
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// teamRule matches requests whose X-Team header matches the pattern.
+func teamRule(pattern string, action string) RawRule {
+	return RawRule{Type: Header, Headers: map[string]string{"X-Team": pattern}, Action: action}
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name          string
+		rules         []RawRule
+		defaultAction string
+		team          string
+		wantAllowed   bool
+		wantReason    string
+		wantWouldDeny string
+	}{
+		{
+			name:        "without actions a match allows",
+			rules:       []RawRule{teamRule("^ops$", "")},
+			team:        "ops",
+			wantAllowed: true,
+			wantReason:  "rules[0] matched",
+		},
+		{
+			name:       "without actions no match denies",
+			rules:      []RawRule{teamRule("^ops$", "")},
+			team:       "dev",
+			wantReason: "no rule matched, default action",
+		},
+		{
+			name:       "first match decides",
+			rules:      []RawRule{teamRule("^ops$", ActionDeny), teamRule(".*", ActionAllow)},
+			team:       "ops",
+			wantReason: "rules[0] matched",
+		},
+		{
+			name:        "later rule decides if earlier rules do not match",
+			rules:       []RawRule{teamRule("^ops$", ActionDeny), teamRule(".*", ActionAllow)},
+			team:        "dev",
+			wantAllowed: true,
+			wantReason:  "rules[1] matched",
+		},
+		{
+			name:          "default action deny",
+			rules:         []RawRule{teamRule("^ops$", ActionAllow)},
+			defaultAction: ActionDeny,
+			team:          "dev",
+			wantReason:    "no rule matched, default action",
+		},
+		{
+			name:          "default action allow",
+			rules:         []RawRule{teamRule("^ops$", ActionDeny)},
+			defaultAction: ActionAllow,
+			team:          "dev",
+			wantAllowed:   true,
+			wantReason:    "no rule matched, default action",
+		},
+		{
+			name: "report mode deny does not decide",
+			rules: []RawRule{
+				{Type: Header, Headers: map[string]string{"X-Team": "^ops$"}, Action: ActionDeny, Mode: ModeReport},
+				teamRule(".*", ActionAllow),
+			},
+			team:          "ops",
+			wantAllowed:   true,
+			wantReason:    "rules[1] matched",
+			wantWouldDeny: "rules[0] matched",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ruleConfig, err := NewRuleConfig(&Config{Rules: test.rules, DefaultAction: test.defaultAction}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ruleConfig.Init()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Team", test.team)
+			decision := ruleConfig.Evaluate(req, nil)
+			if decision.Allowed != test.wantAllowed || decision.Reason != test.wantReason || decision.WouldDeny != test.wantWouldDeny {
+				t.Errorf("got %+v, want allowed %v, reason %q, wouldDeny %q", decision, test.wantAllowed, test.wantReason, test.wantWouldDeny)
+			}
+		})
+	}
+}
+
+func TestRuleActionErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   string
+	}{
+		{"unknown action", Config{Rules: []RawRule{teamRule(".*", "block")}}, "unknown rule action"},
+		{"unknown default action", Config{Rules: []RawRule{teamRule(".*", "")}, DefaultAction: "block"}, "invalid default action"},
+		{"unknown mode", Config{Rules: []RawRule{{Type: Header, Headers: map[string]string{"X-Team": ".*"}, Mode: "audit"}}}, "unknown rule mode"},
+		{"nested action", Config{Rules: []RawRule{{Type: AnyOf, Rules: []RawRule{teamRule(".*", ActionDeny)}}}}, "only supported on top-level rules"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewRuleConfig(&test.config, nil)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("expected an error containing %q, got %v", test.want, err)
+			}
+		})
+	}
+}
+
+func TestRuleDefinitions(t *testing.T) {
+	definitions := map[string]RawRule{
+		"ops":      teamRule("^ops$", ""),
+		"dev":      teamRule("^dev$", ""),
+		"staff":    {Type: AnyOf, Rules: []RawRule{{Ref: "ops"}, {Type: Ref, Ref: "dev"}}},
+		"onCall":   {Type: AllOf, Rules: []RawRule{{Ref: "staff"}, {Type: Header, Headers: map[string]string{"X-On-Call": "^true$"}}}},
+		"external": {Type: NoneOf, Rules: []RawRule{{Ref: "staff"}}},
+	}
+	tests := []struct {
+		ref     string
+		team    string
+		onCall  bool
+		allowed bool
+	}{
+		{"ops", "ops", false, true},
+		{"ops", "dev", false, false},
+		{"staff", "dev", false, true},
+		{"staff", "sales", false, false},
+		{"onCall", "ops", true, true},
+		{"onCall", "ops", false, false},
+		{"external", "sales", false, true},
+		{"external", "dev", false, false},
+	}
+	for _, test := range tests {
+		ruleConfig, err := NewRuleConfig(&Config{Rules: []RawRule{{Ref: test.ref}}, Definitions: definitions}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ruleConfig.Init()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Team", test.team)
+		if test.onCall {
+			req.Header.Set("X-On-Call", "true")
+		}
+		if got := ruleConfig.Match(req); got != test.allowed {
+			t.Errorf("ref %s, team %s, on call %v: allowed %v, want %v", test.ref, test.team, test.onCall, got, test.allowed)
+		}
+	}
+}
+
+func TestRuleDefinitionErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		rules       []RawRule
+		definitions map[string]RawRule
+		want        string
+	}{
+		{
+			name:  "unknown ref",
+			rules: []RawRule{{Ref: "missing"}},
+			want:  "unknown rule definition: missing",
+		},
+		{
+			name:        "unknown ref in an unused definition",
+			rules:       []RawRule{teamRule(".*", "")},
+			definitions: map[string]RawRule{"broken": {Type: AllOf, Rules: []RawRule{{Ref: "missing"}}}},
+			want:        "unknown rule definition: missing",
+		},
+		{
+			name:        "direct cycle",
+			rules:       []RawRule{{Ref: "self"}},
+			definitions: map[string]RawRule{"self": {Type: AnyOf, Rules: []RawRule{{Ref: "self"}}}},
+			want:        "cyclic rule reference: self -> self",
+		},
+		{
+			name:  "indirect cycle",
+			rules: []RawRule{teamRule(".*", "")},
+			definitions: map[string]RawRule{
+				"a": {Type: AllOf, Rules: []RawRule{{Ref: "b"}}},
+				"b": {Type: AnyOf, Rules: []RawRule{teamRule(".*", ""), {Ref: "c"}}},
+				"c": {Ref: "a"},
+			},
+			want: "cyclic rule reference: a -> b -> c -> a",
+		},
+		{
+			name:        "action in a definition",
+			rules:       []RawRule{{Ref: "deny"}},
+			definitions: map[string]RawRule{"deny": teamRule(".*", ActionDeny)},
+			want:        "rule definition deny: action and mode are only supported on top-level rules",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewRuleConfig(&Config{Rules: test.rules, Definitions: test.definitions}, nil)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("expected an error containing %q, got %v", test.want, err)
+			}
+		})
+	}
+}
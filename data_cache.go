@@ -0,0 +1,60 @@
+package tlsguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// dataCacheEntry is the last successful response of a source stored on disk.
+// Signed sources keep the raw body and signature, so the cache is verified again.
+type dataCacheEntry struct {
+	URL       string    `json:"url"`
+	FetchedAt time.Time `json:"fetchedAt"`
+	Body      []byte    `json:"body"`
+	Signature string    `json:"signature,omitempty"` // detached signature of the body of signed sources
+}
+
+// writeDataCache stores the response atomically, so a crash never leaves a partial file.
+func writeDataCache(filename string, entry dataCacheEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// readDataCache loads a stored response of the URL.
+func readDataCache(filename, url string) (dataCacheEntry, error) {
+	var entry dataCacheEntry
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return entry, err
+	}
+	err = json.Unmarshal(data, &entry)
+	if err != nil {
+		return entry, fmt.Errorf("invalid cache file %s: %w", filename, err)
+	}
+	if entry.URL != url {
+		return entry, fmt.Errorf("cache file %s belongs to %s", filename, entry.URL)
+	}
+	return entry, nil
+}
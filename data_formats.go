@@ -0,0 +1,161 @@
+package tlsguard
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Define external data format constants
+const (
+	FormatJSON  string = "json"
+	FormatYAML  string = "yaml"
+	FormatCSV   string = "csv"
+	FormatLines string = "lines"
+)
+
+// CSVOptions configures parsing of CSV data.
+type CSVOptions struct {
+	Column    string `json:"column,omitempty"`    // header name or zero-based index; selects a list of values
+	NoHeader  bool   `json:"noHeader,omitempty"`  // the first row is data, rows become lists
+	Separator string `json:"separator,omitempty"` // defaults to a comma
+}
+
+// checkDataFormat validates the format options of a source.
+func checkDataFormat(config ExternalData) error {
+	switch config.Format {
+	case "", FormatJSON, FormatYAML, FormatLines:
+	case FormatCSV:
+		if len([]rune(config.CSV.Separator)) > 1 {
+			return fmt.Errorf("csv separator must be a single character")
+		}
+		if config.CSV.NoHeader && config.CSV.Column != "" {
+			if _, err := strconv.Atoi(config.CSV.Column); err != nil {
+				return fmt.Errorf("csv column must be an index without header")
+			}
+		}
+	default:
+		return fmt.Errorf("unknown data format: %s", config.Format)
+	}
+	return nil
+}
+
+// parseExternalData decodes a response body in the configured format. All
+// formats produce the shapes of encoding/json: objects, lists and scalars.
+func parseExternalData(body []byte, config ExternalData) (interface{}, error) {
+	switch config.Format {
+	case FormatYAML:
+		return parseYAML(body)
+	case FormatCSV:
+		return parseCSV(body, config.CSV)
+	case FormatLines:
+		return parseLines(body), nil
+	default:
+		var data interface{}
+		err := json.Unmarshal(body, &data)
+		if err != nil {
+			return nil, err
+		}
+		if config.GraphQL.Query != "" {
+			err = checkGraphQLErrors(data)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	}
+}
+
+// parseLines returns the non-empty lines without # and ; comments, e.g. of
+// the Spamhaus DROP list.
+func parseLines(body []byte) []interface{} {
+	lines := []interface{}{}
+	for _, line := range strings.Split(string(body), "\n") {
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// parseCSV returns the rows as objects keyed by the header, as lists without
+// header, or the values of the selected column.
+func parseCSV(body []byte, options CSVOptions) (interface{}, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+	if options.Separator != "" {
+		reader.Comma = []rune(options.Separator)[0]
+	}
+
+	var header []string
+	if !options.NoHeader {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return []interface{}{}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading csv header: %w", err)
+		}
+		header = record
+	}
+
+	column := -1
+	if options.Column != "" {
+		index, err := strconv.Atoi(options.Column)
+		if err == nil {
+			column = index
+		} else {
+			for i, name := range header {
+				if strings.TrimSpace(name) == options.Column {
+					column = i
+				}
+			}
+			if column < 0 {
+				return nil, fmt.Errorf("csv column %s not found", options.Column)
+			}
+		}
+	}
+
+	rows := []interface{}{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading csv: %w", err)
+		}
+
+		switch {
+		case column >= 0:
+			if column < len(record) && strings.TrimSpace(record[column]) != "" {
+				rows = append(rows, strings.TrimSpace(record[column]))
+			}
+		case header != nil:
+			row := make(map[string]interface{}, len(header))
+			for i, name := range header {
+				if i < len(record) {
+					row[strings.TrimSpace(name)] = record[i]
+				}
+			}
+			rows = append(rows, row)
+		default:
+			row := make([]interface{}, 0, len(record))
+			for _, value := range record {
+				row = append(row, value)
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
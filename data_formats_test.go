@@ -0,0 +1,208 @@
+package tlsguard
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want interface{}
+	}{
+		{
+			name: "scalars",
+			yaml: "string: plain text\nint: 42\nfloat: -1.5\nyes: true\nno: False\nnothing: null\ntilde: ~\nempty:\nhex: 0x1F\nversion: 1.2.3\ninf: inf\n",
+			want: map[string]interface{}{
+				"string": "plain text", "int": 42.0, "float": -1.5, "yes": true, "no": false,
+				"nothing": nil, "tilde": nil, "empty": nil, "hex": "0x1F", "version": "1.2.3", "inf": "inf",
+			},
+		},
+		{
+			name: "quoting",
+			yaml: "double: \"a: b # not a comment\\n\"\nsingle: 'it''s # here'\nnumber: \"42\"\n\"quoted key\": value\n'single key': 1\nurl: http://example.org:8080/path\n",
+			want: map[string]interface{}{
+				"double": "a: b # not a comment\n", "single": "it's # here", "number": "42",
+				"quoted key": "value", "single key": 1.0, "url": "http://example.org:8080/path",
+			},
+		},
+		{
+			name: "nested maps and lists",
+			yaml: "---\nnetworks:\n  office:\n    ranges:\n      - 192.0.2.0/24\n      - 198.51.100.0/24\n  vpn:\n    ranges: [203.0.113.0/24]\nusers:\n- name: alice\n  groups: [ops, dev]\n- name: bob\n  groups:\n  - sales\n-\n  name: carol\n...\n",
+			want: map[string]interface{}{
+				"networks": map[string]interface{}{
+					"office": map[string]interface{}{"ranges": []interface{}{"192.0.2.0/24", "198.51.100.0/24"}},
+					"vpn":    map[string]interface{}{"ranges": []interface{}{"203.0.113.0/24"}},
+				},
+				"users": []interface{}{
+					map[string]interface{}{"name": "alice", "groups": []interface{}{"ops", "dev"}},
+					map[string]interface{}{"name": "bob", "groups": []interface{}{"sales"}},
+					map[string]interface{}{"name": "carol"},
+				},
+			},
+		},
+		{
+			name: "flow collections",
+			yaml: "flow: {a: 1, b: [x, 'y, z'], c: {d: \"e\"}}\nnested: [[1, 2], []]\n",
+			want: map[string]interface{}{
+				"flow":   map[string]interface{}{"a": 1.0, "b": []interface{}{"x", "y, z"}, "c": map[string]interface{}{"d": "e"}},
+				"nested": []interface{}{[]interface{}{1.0, 2.0}, []interface{}{}},
+			},
+		},
+		{
+			name: "comments",
+			yaml: "# feed header\n\nranges: # list\n  # first\n  - 192.0.2.0/24 # office\n\n  - host#1\n",
+			want: map[string]interface{}{"ranges": []interface{}{"192.0.2.0/24", "host#1"}},
+		},
+		{
+			name: "block scalars",
+			yaml: "literal: |\n  line one\n    indented\n  line two\nfolded: >-\n  folded\n  text\nnext: 1\n",
+			want: map[string]interface{}{"literal": "line one\n  indented\nline two\n", "folded": "folded text", "next": 1.0},
+		},
+		{
+			name: "top-level list",
+			yaml: "- 192.0.2.1\n- 192.0.2.2\n",
+			want: []interface{}{"192.0.2.1", "192.0.2.2"},
+		},
+		{
+			name: "windows line endings",
+			yaml: "a: 1\r\nb: 2\r\n",
+			want: map[string]interface{}{"a": 1.0, "b": 2.0},
+		},
+		{
+			name: "empty document",
+			yaml: "# nothing\n",
+			want: nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(test.yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{"tab indentation", "a:\n\t- 1\n", "line 2: tabs are not allowed"},
+		{"deeper mapping entry", "a: 1\n  b: 2\n", "line 2: unexpected indentation"},
+		{"deeper sequence item", "- 1\n   - 2\n", "line 2: unexpected indentation"},
+		{"missing key", "a:\n  b: 1\n  plain\n", "line 3: expected key"},
+		{"content after the root", "- 1\nkey: value\n", "line 2: unexpected content"},
+		{"unclosed flow", "a: [1, 2\n", "line 1: missing ]"},
+		{"invalid quote", "a: \"open\n", "line 1: invalid quoted string"},
+		{"anchor", "a: &anchor 1\n", "anchors, aliases and tags are not supported"},
+		{"alias", "a: *anchor\n", "anchors, aliases and tags are not supported"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseYAML([]byte(test.yaml))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("expected an error containing %q, got %v", test.want, err)
+			}
+		})
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	body := "network, site ,owner\n# comment\n192.0.2.0/24,office,\"Ops, Team\"\n198.51.100.0/24,\"branch \"\"b\"\"\"\n\n203.0.113.0/24\n"
+	tests := []struct {
+		name    string
+		body    string
+		options CSVOptions
+		want    interface{}
+	}{
+		{
+			name: "header row",
+			body: body,
+			want: []interface{}{
+				map[string]interface{}{"network": "192.0.2.0/24", "site": "office", "owner": "Ops, Team"},
+				map[string]interface{}{"network": "198.51.100.0/24", "site": `branch "b"`},
+				map[string]interface{}{"network": "203.0.113.0/24"},
+			},
+		},
+		{
+			name:    "column by name",
+			body:    body,
+			options: CSVOptions{Column: "site"},
+			want:    []interface{}{"office", `branch "b"`},
+		},
+		{
+			name:    "column by index",
+			body:    body,
+			options: CSVOptions{Column: "0"},
+			want:    []interface{}{"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24"},
+		},
+		{
+			name:    "no header",
+			body:    "192.0.2.0/24;office\n198.51.100.0/24\n",
+			options: CSVOptions{NoHeader: true, Separator: ";"},
+			want:    []interface{}{[]interface{}{"192.0.2.0/24", "office"}, []interface{}{"198.51.100.0/24"}},
+		},
+		{
+			name: "only a header",
+			body: "network,site\n",
+			want: []interface{}{},
+		},
+		{
+			name: "empty",
+			body: "",
+			want: []interface{}{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseCSV([]byte(test.body), test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+
+	_, err := parseCSV([]byte(body), CSVOptions{Column: "missing"})
+	if err == nil {
+		t.Error("expected an error for an unknown column")
+	}
+	_, err = parseCSV([]byte("a,b\n\"unterminated\n"), CSVOptions{})
+	if err == nil {
+		t.Error("expected an error for an unterminated quote")
+	}
+}
+
+func TestCheckDataFormat(t *testing.T) {
+	for _, config := range []ExternalData{
+		{Format: "xml"},
+		{Format: FormatCSV, CSV: CSVOptions{Separator: ";;"}},
+		{Format: FormatCSV, CSV: CSVOptions{NoHeader: true, Column: "site"}},
+	} {
+		if checkDataFormat(config) == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+}
+
+func TestParseLines(t *testing.T) {
+	body := "; Spamhaus DROP List\r\n\r\n192.0.2.0/24 ; SBL1\n  198.51.100.0/24\t\n# comment\n   \n203.0.113.0/24#inline"
+	want := []interface{}{"192.0.2.0/24", "198.51.100.0/24", "203.0.113.0/24"}
+	if got := parseLines([]byte(body)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+	if got := parseLines(nil); !reflect.DeepEqual(got, []interface{}{}) {
+		t.Errorf("empty body gives %#v", got)
+	}
+}
@@ -0,0 +1,48 @@
+package tlsguard
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// RuleDataFresh matches while the data of an external source is younger than
+// MaxAge. Combine it with other rules to fail open or closed on stale data.
+type RuleDataFresh struct {
+	Source string `json:"source"` // name of the external source, empty for externalData
+	MaxAge string `json:"maxAge"`
+
+	// Internal
+	maxAge time.Duration
+	store  *externalDataStore
+}
+
+// Init parses the maximum age and checks the source.
+func (r *RuleDataFresh) Init() error {
+	duration, err := time.ParseDuration(r.MaxAge)
+	if err != nil {
+		return fmt.Errorf("error parsing maxAge of dataFresh rule: %w", err)
+	}
+	r.maxAge = duration
+	if !r.store.has(r.Source) {
+		return fmt.Errorf("dataFresh rule: unknown external source %q", r.Source)
+	}
+	return nil
+}
+
+// Match checks if the data is fresh.
+func (r *RuleDataFresh) Match(req *http.Request) bool {
+	return r.MatchTrace(req, nil, "")
+}
+
+// MatchTrace checks if the data is fresh and records the result.
+func (r *RuleDataFresh) MatchTrace(req *http.Request, trace *Trace, path string) bool {
+	age, ok := r.store.age(r.Source)
+	if !ok {
+		trace.addf(path, DataFresh, false, "no data for source %q", r.Source)
+		return false
+	}
+	matched := age <= r.maxAge
+	trace.addf(path, DataFresh, matched, "data of source %q is %s old, max %s", r.Source, age.Round(time.Second), r.maxAge)
+	return matched
+}
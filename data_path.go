@@ -0,0 +1,171 @@
+package tlsguard
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// dataPathStep is a single step of a data path.
+type dataPathStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseDataPath parses a path like $.result.networks[*].cidr. Supported steps
+// are .key, ['key'], [n] (negative counts from the end), [*] and .*.
+func parseDataPath(path string) ([]dataPathStep, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("data path must start with $: %s", path)
+	}
+
+	var steps []dataPathStep
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			key := rest[:end]
+			rest = rest[end:]
+			switch key {
+			case "":
+				return nil, fmt.Errorf("empty key in data path: %s", path)
+			case "*":
+				steps = append(steps, dataPathStep{wildcard: true})
+			default:
+				steps = append(steps, dataPathStep{key: key})
+			}
+		case '[':
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("missing ] in data path: %s", path)
+			}
+			selector := strings.TrimSpace(rest[1:end])
+			rest = rest[end+1:]
+			switch {
+			case selector == "*":
+				steps = append(steps, dataPathStep{wildcard: true})
+			case len(selector) >= 2 && (selector[0] == '\'' || selector[0] == '"') && selector[len(selector)-1] == selector[0]:
+				steps = append(steps, dataPathStep{key: selector[1 : len(selector)-1]})
+			default:
+				index, err := strconv.Atoi(selector)
+				if err != nil {
+					return nil, fmt.Errorf("invalid index %s in data path: %s", selector, path)
+				}
+				steps = append(steps, dataPathStep{index: index, isIndex: true})
+			}
+		default:
+			return nil, fmt.Errorf("unexpected %q in data path: %s", rest[0], path)
+		}
+	}
+	return steps, nil
+}
+
+// selectDataPath returns the value at the path. Wildcards collect the results
+// of all elements into a flat list, skipping missing values.
+func selectDataPath(value interface{}, steps []dataPathStep) interface{} {
+	result, _ := evalDataPath(value, steps)
+	return result
+}
+
+// evalDataPath walks the steps and reports whether the result is a wildcard list.
+func evalDataPath(value interface{}, steps []dataPathStep) (interface{}, bool) {
+	if len(steps) == 0 || value == nil {
+		return value, false
+	}
+
+	step, rest := steps[0], steps[1:]
+	switch {
+	case step.wildcard:
+		var elements []interface{}
+		switch v := value.(type) {
+		case []interface{}:
+			elements = v
+		case map[string]interface{}:
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				elements = append(elements, v[key])
+			}
+		default:
+			return nil, false
+		}
+
+		results := make([]interface{}, 0, len(elements))
+		for _, element := range elements {
+			result, multi := evalDataPath(element, rest)
+			switch {
+			case result == nil:
+				continue
+			case multi:
+				results = append(results, result.([]interface{})...)
+			default:
+				results = append(results, result)
+			}
+		}
+		return results, true
+	case step.isIndex:
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil, false
+		}
+		index := step.index
+		if index < 0 {
+			index += len(list)
+		}
+		if index < 0 || index >= len(list) {
+			return nil, false
+		}
+		return evalDataPath(list[index], rest)
+	default:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		return evalDataPath(object[step.key], rest)
+	}
+}
+
+// joinValues is the join template function: lists are joined with the
+// separator, other values are formatted as is.
+func joinValues(separator string, value interface{}) string {
+	list, ok := value.([]interface{})
+	if !ok {
+		if value == nil {
+			return ""
+		}
+		return fmt.Sprint(value)
+	}
+	parts := make([]string, 0, len(list))
+	for _, element := range list {
+		parts = append(parts, fmt.Sprint(element))
+	}
+	return strings.Join(parts, separator)
+}
+
+// regexAny is the regexAny template function: it returns a regular expression
+// matching exactly one of the values, for use in header rules.
+func regexAny(value interface{}) string {
+	list, ok := value.([]interface{})
+	if !ok {
+		list = []interface{}{value}
+	}
+	parts := make([]string, 0, len(list))
+	for _, element := range list {
+		if element != nil {
+			parts = append(parts, regexp.QuoteMeta(fmt.Sprint(element)))
+		}
+	}
+	return "^(?:" + strings.Join(parts, "|") + ")$"
+}
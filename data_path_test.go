@@ -0,0 +1,78 @@
+package tlsguard
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestTemplateFunctionsAreNotEscaped(t *testing.T) {
+	data := map[string]interface{}{
+		"users": []interface{}{"alice+ops@example.com", "o'brien & co", `"quoted"`},
+	}
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{template: `[[ regexAny .users ]]`, want: `^(?:alice\+ops@example\.com|o'brien & co|"quoted")$`},
+		{template: `[[ join "," .users ]]`, want: `alice+ops@example.com,o'brien & co,"quoted"`},
+		{template: `[[ index .users 0 ]]`, want: `alice+ops@example.com`},
+	}
+	for _, test := range tests {
+		got, err := templateValue(test.template, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.template, got, test.want)
+		}
+	}
+}
+
+func TestRulesFromTemplatedData(t *testing.T) {
+	dataFile := filepath.Join(t.TempDir(), "data.json")
+	writeTestFile(t, dataFile, `{"users": ["alice+ops@example.com", "bob@example.com"], "ranges": ["192.0.2.0/24", "2001:db8::/32"]}`)
+
+	config := &Config{
+		ExternalData: ExternalData{URL: "file://" + dataFile},
+		Rules: []RawRule{{
+			Type: AllOf,
+			Rules: []RawRule{
+				{Type: Header, Headers: map[string]string{"X-User": `[[ regexAny .data.users ]]`}},
+				{Type: IPRange, Ranges: []string{`[[ join "," .data.ranges ]]`}},
+			},
+		}},
+	}
+	store, err := newExternalDataStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := NewRuleConfig(config, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rules.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user string
+		ip   string
+		want bool
+	}{
+		{user: "alice+ops@example.com", ip: "192.0.2.10", want: true},
+		{user: "bob@example.com", ip: "2001:db8::1", want: true},
+		{user: "aliceops@example.com", ip: "192.0.2.10"},
+		{user: "alice+ops@example.com", ip: "198.51.100.1"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", test.user)
+		req.Header.Set("X-Real-Ip", test.ip)
+		if got := rules.Match(req); got != test.want {
+			t.Errorf("%s from %s: got %v, want %v", test.user, test.ip, got, test.want)
+		}
+	}
+}
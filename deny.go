@@ -0,0 +1,294 @@
+package tlsguard
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Define deny reason constants
+const (
+	DenyReasonCertificateRequired string = "certificateRequired" // no certificate and no rules
+	DenyReasonCertificateUnknown  string = "certificateUnknown"  // certificate without user, denied by the rules
+	DenyReasonCertificateExpired  string = "certificateExpired"  // expired or not yet valid certificate, denied by the rules
+	DenyReasonRulesDenied         string = "rulesDenied"         // no certificate, denied by the rules
+
+	problemContentType string = "application/problem+json"
+	requestIDHeader    string = "X-Request-Id"
+	maxRequestIDLength        = 128
+)
+
+// denyMessages are the default messages per deny reason.
+var denyMessages = map[string]string{
+	DenyReasonCertificateRequired: "TLS client certificate is required for authentication",
+	DenyReasonCertificateUnknown:  "Forbidden",
+	DenyReasonCertificateExpired:  "Forbidden",
+	DenyReasonRulesDenied:         "Forbidden",
+}
+
+// DenyResponse configures the response to denied requests.
+type DenyResponse struct {
+	StatusCode     int               `json:"statusCode,omitempty"`
+	ContentType    string            `json:"contentType,omitempty"`
+	Body           string            `json:"body,omitempty"`           // template with .RequestID, .Reason, .Message, .Status and .Req
+	ProblemDetails bool              `json:"problemDetails,omitempty"` // respond with RFC 7807 application/problem+json
+	ProblemType    string            `json:"problemType,omitempty"`    // problem type URI, defaults to about:blank
+	Headers        map[string]string `json:"headers,omitempty"`        // templates like body
+	RedirectURL    string            `json:"redirectUrl,omitempty"`    // redirect instead of responding, templated like body
+}
+
+// denyTemplate is a text/template or, for HTML bodies, an html/template.
+type denyTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// compiledDenyResponse holds the parsed templates of a deny response.
+type compiledDenyResponse struct {
+	config   DenyResponse
+	body     denyTemplate
+	redirect *template.Template
+	headers  map[string]*template.Template
+}
+
+// denyResponder writes the responses for denied requests.
+type denyResponder struct {
+	defaultResponse *compiledDenyResponse
+	byReason        map[string]*compiledDenyResponse
+	page            *denyPageRenderer // nil if disabled
+}
+
+// newDenyResponder compiles the configured deny responses.
+func newDenyResponder(config *Config) (*denyResponder, error) {
+	defaultResponse, err := compileDenyResponse("denyResponse", config.DenyResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := newDenyPageRenderer(config.DenyPage)
+	if err != nil {
+		return nil, err
+	}
+
+	responder := &denyResponder{
+		defaultResponse: defaultResponse,
+		byReason:        make(map[string]*compiledDenyResponse, len(config.DenyResponses)),
+		page:            page,
+	}
+	for reason, response := range config.DenyResponses {
+		if _, ok := denyMessages[reason]; !ok {
+			return nil, fmt.Errorf("unknown deny reason: %s", reason)
+		}
+		responder.byReason[reason], err = compileDenyResponse("denyResponses."+reason, response)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return responder, nil
+}
+
+func compileDenyResponse(name string, config DenyResponse) (*compiledDenyResponse, error) {
+	if config.StatusCode != 0 && (config.StatusCode < 100 || config.StatusCode > 599) {
+		return nil, fmt.Errorf("%s: invalid status code %d", name, config.StatusCode)
+	}
+
+	compiled := &compiledDenyResponse{
+		config:  config,
+		headers: make(map[string]*template.Template, len(config.Headers)),
+	}
+	var err error
+	if config.Body != "" {
+		// HTML bodies are escaped, since the request ID and request come from the client
+		if isHTMLContentType(config.ContentType) {
+			compiled.body, err = htmltemplate.New(name+".body").Delims("[[", "]]").Parse(config.Body)
+		} else {
+			compiled.body, err = template.New(name+".body").Delims("[[", "]]").Parse(config.Body)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if config.RedirectURL != "" {
+		compiled.redirect, err = template.New(name+".redirectUrl").Delims("[[", "]]").Parse(config.RedirectURL)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for headerName, value := range config.Headers {
+		compiled.headers[headerName], err = template.New(name+".headers."+headerName).Delims("[[", "]]").Parse(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return compiled, nil
+}
+
+// respond writes the deny response for the reason.
+func (d *denyResponder) respond(rw http.ResponseWriter, req *http.Request, reason string) {
+	response, ok := d.byReason[reason]
+	if !ok {
+		response = d.defaultResponse
+	}
+
+	status := response.config.StatusCode
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	message := denyMessages[reason]
+	requestID := getRequestID(req)
+	data := map[string]interface{}{
+		"RequestID": requestID,
+		"Reason":    reason,
+		"Message":   message,
+		"Status":    status,
+		"Req":       req,
+	}
+
+	for headerName, tmpl := range response.headers {
+		value, err := executeTemplate(tmpl, data)
+		if err != nil {
+			fmt.Printf("Error executing template for deny header %s: %v\n", headerName, err)
+			continue
+		}
+		rw.Header().Set(headerName, value)
+	}
+
+	if response.redirect != nil {
+		location, err := executeTemplate(response.redirect, data)
+		if err == nil {
+			if status < 300 || status > 399 {
+				status = http.StatusFound
+			}
+			http.Redirect(rw, req, location, status)
+			return
+		}
+		fmt.Printf("Error executing redirect template: %v\n", err)
+	}
+
+	// Browsers get an HTML page explaining the reason, unless a body or
+	// problem details are configured for it
+	if d.page != nil && response.body == nil && !response.config.ProblemDetails {
+		rw.Header().Add("Vary", "Accept")
+		if prefersHTML(req.Header.Get("Accept")) {
+			err := d.page.render(rw, status, data)
+			if err == nil {
+				return
+			}
+			fmt.Printf("Error executing deny page template: %v\n", err)
+		}
+	}
+
+	switch {
+	case response.body != nil:
+		body, err := executeTemplate(response.body, data)
+		if err != nil {
+			fmt.Printf("Error executing deny body template: %v\n", err)
+			body = message
+		}
+		contentType := response.config.ContentType
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+		writeDenyBody(rw, status, contentType, body)
+	case response.config.ProblemDetails:
+		problemType := response.config.ProblemType
+		if problemType == "" {
+			problemType = "about:blank"
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"type":      problemType,
+			"title":     http.StatusText(status),
+			"status":    status,
+			"detail":    message,
+			"instance":  req.URL.Path,
+			"reason":    reason,
+			"requestId": requestID,
+		})
+		writeDenyBody(rw, status, problemContentType, string(body))
+	default:
+		contentType := response.config.ContentType
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+		writeDenyBody(rw, status, contentType, message+"\n")
+	}
+}
+
+// writeDenyBody writes a deny response body.
+func writeDenyBody(rw http.ResponseWriter, status int, contentType, body string) {
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(status)
+	_, _ = rw.Write([]byte(body))
+}
+
+// isHTMLContentType reports whether a content type is interpreted as HTML by browsers.
+func isHTMLContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return strings.Contains(mediaType, "html") || strings.HasSuffix(mediaType, "+xml") || mediaType == "image/svg+xml"
+}
+
+// executeTemplate renders a template to a string.
+func executeTemplate(tmpl denyTemplate, data interface{}) (string, error) {
+	var output strings.Builder
+	err := tmpl.Execute(&output, data)
+	if err != nil {
+		return "", err
+	}
+	return output.String(), nil
+}
+
+// getRequestID returns the X-Request-Id of the request or a random ID. IDs
+// other than short tokens of letters, digits and -_.: are replaced, since
+// the header comes from the client.
+func getRequestID(req *http.Request) string {
+	if requestID := req.Header.Get(requestIDHeader); isSafeRequestID(requestID) {
+		return requestID
+	}
+	return randomID()
+}
+
+// isSafeRequestID reports whether a request ID can be reflected in responses.
+func isSafeRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range requestID {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// randomID returns a random hex ID.
+func randomID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// denyReason classifies why the rules denied a request.
+func denyReason(info *requestInfo) string {
+	switch {
+	case info.Cert == nil:
+		return DenyReasonRulesDenied
+	case time.Now().After(info.Cert.NotAfter) || time.Now().Before(info.Cert.NotBefore):
+		return DenyReasonCertificateExpired
+	default:
+		return DenyReasonCertificateUnknown
+	}
+}
@@ -0,0 +1,148 @@
+package tlsguard
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DenyPage configures the HTML page shown to browsers on denied requests.
+type DenyPage struct {
+	Disabled     bool   `json:"disabled,omitempty"`
+	TemplateFile string `json:"templateFile,omitempty"` // html/template with [[ ]] delimiters
+}
+
+// denyPageTexts explain each deny reason to the user.
+var denyPageTexts = map[string][2]string{
+	DenyReasonCertificateRequired: {
+		"Client certificate required",
+		"This page can only be accessed with a client certificate, but your browser did not present one. Please install your certificate or contact your administrator.",
+	},
+	DenyReasonCertificateUnknown: {
+		"Certificate not recognized",
+		"Your browser presented a client certificate that is not registered for this service. Please select a different certificate or contact your administrator.",
+	},
+	DenyReasonCertificateExpired: {
+		"Certificate expired",
+		"Your client certificate has expired or is not yet valid. Please renew your certificate or contact your administrator.",
+	},
+	DenyReasonRulesDenied: {
+		"Access denied",
+		"Your network is not allowed to access this page and your browser did not present a client certificate. Please connect from an allowed network, install your certificate or contact your administrator.",
+	},
+}
+
+const defaultDenyPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>[[ .Status ]] [[ .Title ]]</title>
+<style>
+body { font-family: system-ui, sans-serif; background: #f4f5f7; color: #1f2328; margin: 0; }
+main { max-width: 36rem; margin: 10vh auto; background: #fff; padding: 2rem 2.5rem; border-radius: 8px; box-shadow: 0 1px 4px rgba(0,0,0,.1); }
+h1 { font-size: 1.5rem; margin-top: 0; }
+p { line-height: 1.5; }
+small { color: #656d76; }
+</style>
+</head>
+<body>
+<main>
+<h1>[[ .Title ]]</h1>
+<p>[[ .Explanation ]]</p>
+<p><small>Error [[ .Status ]] &middot; Reason [[ .Reason ]] &middot; Request ID [[ .RequestID ]]</small></p>
+</main>
+</body>
+</html>
+`
+
+// denyPageRenderer renders the HTML deny page.
+type denyPageRenderer struct {
+	tmpl *template.Template
+}
+
+// newDenyPageRenderer parses the configured or built-in deny page. It returns nil if the page is disabled.
+func newDenyPageRenderer(config DenyPage) (*denyPageRenderer, error) {
+	if config.Disabled {
+		return nil, nil
+	}
+
+	page := defaultDenyPage
+	if config.TemplateFile != "" {
+		data, err := os.ReadFile(config.TemplateFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading deny page template: %w", err)
+		}
+		page = string(data)
+	}
+
+	tmpl, err := template.New("denyPage").Delims("[[", "]]").Parse(page)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing deny page template: %w", err)
+	}
+	return &denyPageRenderer{tmpl: tmpl}, nil
+}
+
+// render writes the deny page with an explanation of the deny reason.
+func (p *denyPageRenderer) render(rw http.ResponseWriter, status int, data map[string]interface{}) error {
+	reason, _ := data["Reason"].(string)
+	texts := denyPageTexts[reason]
+	pageData := make(map[string]interface{}, len(data)+2)
+	for key, value := range data {
+		pageData[key] = value
+	}
+	pageData["Title"] = texts[0]
+	pageData["Explanation"] = texts[1]
+
+	var output strings.Builder
+	err := p.tmpl.Execute(&output, pageData)
+	if err != nil {
+		return err
+	}
+	writeDenyBody(rw, status, "text/html; charset=utf-8", output.String())
+	return nil
+}
+
+// prefersHTML reports whether the Accept header prefers HTML over other
+// explicitly listed types. Wildcards alone (e.g. curl's */*) do not select HTML.
+func prefersHTML(accept string) bool {
+	htmlQuality, otherQuality := -1.0, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, quality := parseAcceptPart(part)
+		switch mediaType {
+		case "":
+			continue
+		case "text/html", "application/xhtml+xml":
+			if quality > htmlQuality {
+				htmlQuality = quality
+			}
+		case "*/*", "text/*", "application/*":
+			// Wildcards do not express a preference
+		default:
+			if quality > otherQuality {
+				otherQuality = quality
+			}
+		}
+	}
+	return htmlQuality > 0 && htmlQuality >= otherQuality
+}
+
+// parseAcceptPart returns the media type and quality of an Accept header element.
+func parseAcceptPart(part string) (string, float64) {
+	params := strings.Split(part, ";")
+	mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+	quality := 1.0
+	for _, param := range params[1:] {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "q=") {
+			q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+			if err == nil {
+				quality = q
+			}
+		}
+	}
+	return mediaType, quality
+}
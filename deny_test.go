@@ -0,0 +1,162 @@
+package tlsguard
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDenyResponseEscapesHTML(t *testing.T) {
+	responder, err := newDenyResponder(&Config{DenyResponse: DenyResponse{
+		ContentType: "text/html; charset=utf-8",
+		Body:        `<p>Request [[ .RequestID ]] to [[ .Req.URL.Path ]] denied</p>`,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/%3Cscript%3Ealert(2)%3C/script%3E", nil)
+	req.Header.Set(requestIDHeader, "<script>alert(1)</script>")
+	rw := httptest.NewRecorder()
+	responder.respond(rw, req, DenyReasonRulesDenied)
+
+	body := rw.Body.String()
+	if strings.Contains(body, "<script>") {
+		t.Errorf("client values must be escaped: %s", body)
+	}
+	if !strings.Contains(body, "&lt;script&gt;alert(2)") {
+		t.Errorf("expected the escaped path: %s", body)
+	}
+}
+
+func TestDenyResponseRequestID(t *testing.T) {
+	responder, err := newDenyResponder(&Config{DenyResponse: DenyResponse{Body: "request [[ .RequestID ]]"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		requestID string
+		reflected bool
+	}{
+		{requestID: "f3b1c2d4-0a9e-4c5b-8d7f-1e2a3b4c5d6e", reflected: true},
+		{requestID: "trace:abc_123.4", reflected: true},
+		{requestID: "<img src=x onerror=alert(1)>"},
+		{requestID: "id with spaces"},
+		{requestID: strings.Repeat("a", maxRequestIDLength+1)},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(requestIDHeader, test.requestID)
+		rw := httptest.NewRecorder()
+		responder.respond(rw, req, DenyReasonRulesDenied)
+
+		body := rw.Body.String()
+		if strings.Contains(body, test.requestID) != test.reflected {
+			t.Errorf("%q: unexpected body %q", test.requestID, body)
+		}
+		if !test.reflected && len(strings.TrimPrefix(body, "request ")) != 16 {
+			t.Errorf("%q: expected a random ID, got %q", test.requestID, body)
+		}
+	}
+}
+
+func TestIsHTMLContentType(t *testing.T) {
+	for contentType, want := range map[string]bool{
+		"text/html":                 true,
+		"TEXT/HTML; charset=utf-8":  true,
+		"application/xhtml+xml":     true,
+		"image/svg+xml":             true,
+		"text/plain; charset=utf-8": false,
+		"application/json":          false,
+		"":                          false,
+	} {
+		if got := isHTMLContentType(contentType); got != want {
+			t.Errorf("%q: got %v, want %v", contentType, got, want)
+		}
+	}
+}
+
+func TestPrefersHTML(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8": true,
+		"application/xhtml+xml":                   true,
+		"text/html;q=0.5, application/json":       false,
+		"application/json;q=0.5, text/html":       true,
+		"text/html;q=0.8, application/json;q=0.8": true,
+		"text/html;q=0":                           false,
+		"*/*":                                     false,
+		"text/*":                                  false,
+		"":                                        false,
+		"application/json":                        false,
+	} {
+		if got := prefersHTML(accept); got != want {
+			t.Errorf("%q: got %v, want %v", accept, got, want)
+		}
+	}
+}
+
+func TestDenyPage(t *testing.T) {
+	responder, err := newDenyResponder(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for reason, texts := range denyPageTexts {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", "text/html")
+		rw := httptest.NewRecorder()
+		responder.respond(rw, req, reason)
+
+		if rw.Code != 403 || !strings.HasPrefix(rw.Header().Get("Content-Type"), "text/html") {
+			t.Errorf("%s: unexpected response %d %s", reason, rw.Code, rw.Header().Get("Content-Type"))
+		}
+		body := rw.Body.String()
+		if !strings.Contains(body, "<h1>"+texts[0]+"</h1>") || !strings.Contains(body, "Reason "+reason) {
+			t.Errorf("%s: page does not explain the reason: %s", reason, body)
+		}
+	}
+
+	// Clients that do not prefer HTML get the plain text response
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "*/*")
+	rw := httptest.NewRecorder()
+	responder.respond(rw, req, DenyReasonCertificateUnknown)
+	if !strings.HasPrefix(rw.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("expected plain text, got %s", rw.Header().Get("Content-Type"))
+	}
+}
+
+func TestConfiguredDenyResponseOverridesPage(t *testing.T) {
+	responder, err := newDenyResponder(&Config{
+		DenyResponse: DenyResponse{ContentType: "text/html", Body: "<p>custom</p>"},
+		DenyResponses: map[string]DenyResponse{
+			DenyReasonCertificateExpired: {ProblemDetails: true},
+			DenyReasonRulesDenied:        {StatusCode: 401},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		reason      string
+		contentType string
+		body        string
+	}{
+		{DenyReasonCertificateRequired, "text/html", "<p>custom</p>"},
+		{DenyReasonCertificateExpired, problemContentType, `"reason":"certificateExpired"`},
+		{DenyReasonRulesDenied, "text/html; charset=utf-8", "<h1>Access denied</h1>"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", "text/html")
+		rw := httptest.NewRecorder()
+		responder.respond(rw, req, test.reason)
+
+		if rw.Header().Get("Content-Type") != test.contentType || !strings.Contains(rw.Body.String(), test.body) {
+			t.Errorf("%s: got %s %q, want %s containing %q", test.reason, rw.Header().Get("Content-Type"), rw.Body.String(), test.contentType, test.body)
+		}
+	}
+}
@@ -0,0 +1,966 @@
+package tlsguard
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Define expression evaluation limits
+const (
+	maxExprCacheEntries  = 256         // dynamic patterns and ranges kept compiled per rule
+	exprErrorLogInterval = time.Minute // evaluation errors are logged at most this often per rule
+)
+
+// RuleExpr implements a rule defined by a boolean expression.
+//
+// The expression language is side-effect free: it can only read the request,
+// the client IP, the client certificate and the external data.
+//
+//	"ops" in cert.ou || (inCidr(ip, "10.0.0.0/8") && req.method == "GET")
+type RuleExpr struct {
+	Expr string      `json:"expr"`
+	Data interface{} `json:"-"`
+
+	// Internal
+	program exprNode
+	cache   *exprCache
+	store   *externalDataStore
+
+	errMutex      sync.Mutex
+	errLoggedAt   time.Time
+	errSuppressed int
+}
+
+// Init compiles the expression.
+func (r *RuleExpr) Init() error {
+	r.cache = &exprCache{}
+	program, variables, err := compileExpr(r.Expr, r.cache)
+	if err != nil {
+		return fmt.Errorf("invalid expression %q: %w", r.Expr, err)
+	}
+	if variables["dataAge"] && r.store == nil {
+		return fmt.Errorf("invalid expression %q: dataAge requires externalData or externalSources", r.Expr)
+	}
+	r.program = program
+	return nil
+}
+
+// Match evaluates the expression for the request.
+func (r *RuleExpr) Match(req *http.Request) bool {
+	return r.MatchTrace(req, nil, "")
+}
+
+// MatchTrace evaluates the expression for the request and records the result.
+func (r *RuleExpr) MatchTrace(req *http.Request, trace *Trace, path string) bool {
+	result, err := r.program.eval(newExprEnv(req, r.Data, r.store.dataAges()))
+	if err != nil {
+		r.logError(err)
+		trace.addf(path, Expr, false, "error evaluating %s: %v", r.Expr, err)
+		return false
+	}
+	matched := exprTruthy(result)
+	trace.addf(path, Expr, matched, "%s evaluated to %v", r.Expr, matched)
+	return matched
+}
+
+// logError logs an evaluation error, at most once per exprErrorLogInterval,
+// since the same error usually repeats on every request.
+func (r *RuleExpr) logError(err error) {
+	r.errMutex.Lock()
+	defer r.errMutex.Unlock()
+
+	if time.Since(r.errLoggedAt) < exprErrorLogInterval {
+		r.errSuppressed++
+		return
+	}
+	if r.errSuppressed > 0 {
+		fmt.Printf("error evaluating expression %q: %v (%d more errors since the last report)\n", r.Expr, err, r.errSuppressed)
+	} else {
+		fmt.Printf("error evaluating expression %q: %v\n", r.Expr, err)
+	}
+	r.errLoggedAt = time.Now()
+	r.errSuppressed = 0
+}
+
+// exprEnv holds the values an expression can access.
+type exprEnv struct {
+	req  *http.Request
+	vars map[string]interface{}
+}
+
+// exprVariables are the identifiers an expression may reference.
+var exprVariables = map[string]bool{
+	"req":     true,
+	"ip":      true,
+	"cert":    true,
+	"data":    true,
+	"dataAge": true,
+}
+
+// newExprEnv builds the expression variables for a request.
+func newExprEnv(req *http.Request, data, dataAge interface{}) *exprEnv {
+	info := getRequestInfo(req)
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+
+	return &exprEnv{
+		req: req,
+		vars: map[string]interface{}{
+			"req": map[string]interface{}{
+				"method": req.Method,
+				"host":   req.Host,
+				"path":   req.URL.Path,
+				"query":  req.URL.RawQuery,
+				"scheme": scheme,
+				"proto":  req.Proto,
+			},
+			"ip":      clientIP(req),
+			"cert":    exprCert(info.Cert),
+			"data":    data,
+			"dataAge": dataAge,
+		},
+	}
+}
+
+// exprCert exposes certificate fields to expressions.
+func exprCert(cert *x509.Certificate) interface{} {
+	if cert == nil {
+		return nil
+	}
+
+	uris := make([]string, 0, len(cert.URIs))
+	for _, uri := range cert.URIs {
+		uris = append(uris, uri.String())
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+
+	return map[string]interface{}{
+		"cn":          cert.Subject.CommonName,
+		"serial":      cert.SerialNumber.String(),
+		"o":           exprStrings(cert.Subject.Organization),
+		"ou":          exprStrings(cert.Subject.OrganizationalUnit),
+		"dns":         exprStrings(cert.DNSNames),
+		"emails":      exprStrings(cert.EmailAddresses),
+		"uris":        exprStrings(uris),
+		"issuer":      cert.Issuer.CommonName,
+		"fingerprint": hex.EncodeToString(fingerprint[:]),
+	}
+}
+
+func exprStrings(values []string) []interface{} {
+	list := make([]interface{}, 0, len(values))
+	for _, value := range values {
+		list = append(list, value)
+	}
+	return list
+}
+
+// exprCache caches regular expressions and CIDRs built from dynamic values.
+// Values can come from request headers, so the cache is emptied when it
+// reaches maxExprCacheEntries instead of growing with every distinct value.
+type exprCache struct {
+	mutex   sync.Mutex
+	regexps map[string]*regexp.Regexp
+	cidrs   map[string]*net.IPNet
+}
+
+func (c *exprCache) regexp(pattern string) (*regexp.Regexp, error) {
+	c.mutex.Lock()
+	cached, ok := c.regexps[pattern]
+	c.mutex.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.regexps == nil || len(c.regexps) >= maxExprCacheEntries {
+		c.regexps = make(map[string]*regexp.Regexp)
+	}
+	c.regexps[pattern] = compiled
+	return compiled, nil
+}
+
+func (c *exprCache) cidr(cidr string) (*net.IPNet, error) {
+	c.mutex.Lock()
+	cached, ok := c.cidrs[cidr]
+	c.mutex.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.cidrs == nil || len(c.cidrs) >= maxExprCacheEntries {
+		c.cidrs = make(map[string]*net.IPNet)
+	}
+	c.cidrs[cidr] = ipNet
+	return ipNet, nil
+}
+
+// Tokenizer
+
+type exprTokenKind int
+
+const (
+	tokenEOF exprTokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type exprToken struct {
+	kind  exprTokenKind
+	text  string
+	value interface{}
+	pos   int
+}
+
+// exprOperators lists the operators, longest first.
+var exprOperators = []string{"==", "!=", "<=", ">=", "=~", "!~", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ",", "."}
+
+func tokenizeExpr(input string) ([]exprToken, error) {
+	var tokens []exprToken
+	pos := 0
+	for pos < len(input) {
+		c := rune(input[pos])
+		switch {
+		case unicode.IsSpace(c):
+			pos++
+		case c == '"' || c == '\'':
+			value, end, err := scanExprString(input, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, exprToken{kind: tokenString, text: input[pos:end], value: value, pos: pos})
+			pos = end
+		case unicode.IsDigit(c):
+			end := pos
+			for end < len(input) && (unicode.IsDigit(rune(input[end])) || input[end] == '.') {
+				end++
+			}
+			value, err := strconv.ParseFloat(input[pos:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number at %d: %s", pos, input[pos:end])
+			}
+			tokens = append(tokens, exprToken{kind: tokenNumber, text: input[pos:end], value: value, pos: pos})
+			pos = end
+		case unicode.IsLetter(c) || c == '_':
+			end := pos
+			for end < len(input) && (unicode.IsLetter(rune(input[end])) || unicode.IsDigit(rune(input[end])) || input[end] == '_') {
+				end++
+			}
+			tokens = append(tokens, exprToken{kind: tokenIdent, text: input[pos:end], pos: pos})
+			pos = end
+		default:
+			operator := ""
+			for _, op := range exprOperators {
+				if strings.HasPrefix(input[pos:], op) {
+					operator = op
+					break
+				}
+			}
+			if operator == "" {
+				return nil, fmt.Errorf("unexpected character %q at %d", c, pos)
+			}
+			tokens = append(tokens, exprToken{kind: tokenOperator, text: operator, pos: pos})
+			pos += len(operator)
+		}
+	}
+	return append(tokens, exprToken{kind: tokenEOF, pos: pos}), nil
+}
+
+// scanExprString reads a single or double quoted string starting at pos.
+func scanExprString(input string, pos int) (string, int, error) {
+	quote := input[pos]
+	var value strings.Builder
+	for i := pos + 1; i < len(input); i++ {
+		switch input[i] {
+		case quote:
+			return value.String(), i + 1, nil
+		case '\\':
+			i++
+			if i >= len(input) {
+				break
+			}
+			switch input[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			default:
+				value.WriteByte(input[i])
+			}
+		default:
+			value.WriteByte(input[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string at %d", pos)
+}
+
+// Parser
+
+type exprParser struct {
+	tokens    []exprToken
+	pos       int
+	cache     *exprCache
+	variables map[string]bool // variables referenced by the expression
+}
+
+// compileExpr parses an expression into an evaluable tree and returns the
+// variables it references.
+func compileExpr(input string, cache *exprCache) (exprNode, map[string]bool, error) {
+	tokens, err := tokenizeExpr(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &exprParser{tokens: tokens, cache: cache, variables: make(map[string]bool)}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, nil, fmt.Errorf("unexpected %q at %d", p.peek().text, p.peek().pos)
+	}
+	return node, p.variables, nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	token := p.tokens[p.pos]
+	if token.kind != tokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+// accept consumes the next token if it is one of the given operators or keywords.
+func (p *exprParser) accept(texts ...string) (string, bool) {
+	token := p.peek()
+	if token.kind != tokenOperator && token.kind != tokenIdent {
+		return "", false
+	}
+	for _, text := range texts {
+		if token.text == text {
+			p.pos++
+			return text, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expect(text string) error {
+	if _, ok := p.accept(text); !ok {
+		return fmt.Errorf("expected %q at %d", text, p.peek().pos)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||", "or"); !ok {
+			return left, nil
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{or: true, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&", "and"); !ok {
+			return left, nil
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if _, ok := p.accept("!", "not"); ok {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+
+	negate := false
+	if p.peek().kind == tokenIdent && p.peek().text == "not" &&
+		p.tokens[p.pos+1].kind == tokenIdent && p.tokens[p.pos+1].text == "in" {
+		p.pos++
+		negate = true
+	}
+	op, ok := p.accept("==", "!=", "<=", ">=", "<", ">", "=~", "!~", "in")
+	if !ok {
+		return left, nil
+	}
+	right, err := p.parsePostfix()
+	if err != nil {
+		return nil, err
+	}
+
+	node := &compareNode{op: op, left: left, right: right, cache: p.cache}
+	if op == "=~" || op == "!~" {
+		// Compile literal patterns once
+		if literal, isLiteral := right.(*literalNode); isLiteral {
+			pattern, isString := literal.value.(string)
+			if !isString {
+				return nil, fmt.Errorf("regular expression must be a string")
+			}
+			node.regex, err = regexp.Compile(pattern)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if negate {
+		return &notNode{operand: node}, nil
+	}
+	return node, nil
+}
+
+func (p *exprParser) parsePostfix() (exprNode, error) {
+	node, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.peek().kind == tokenOperator && p.peek().text == ".":
+			p.next()
+			name := p.next()
+			if name.kind != tokenIdent {
+				return nil, fmt.Errorf("expected field name at %d", name.pos)
+			}
+			node = &indexNode{target: node, index: &literalNode{value: name.text}}
+		case p.peek().kind == tokenOperator && p.peek().text == "[":
+			p.next()
+			index, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect("]"); err != nil {
+				return nil, err
+			}
+			node = &indexNode{target: node, index: index}
+		default:
+			return node, nil
+		}
+	}
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	token := p.next()
+	switch token.kind {
+	case tokenString, tokenNumber:
+		return &literalNode{value: token.value}, nil
+	case tokenIdent:
+		switch token.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null", "nil":
+			return &literalNode{value: nil}, nil
+		}
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(token)
+		}
+		if !exprVariables[token.text] {
+			return nil, fmt.Errorf("unknown identifier %q at %d", token.text, token.pos)
+		}
+		p.variables[token.text] = true
+		return &variableNode{name: token.text}, nil
+	case tokenOperator:
+		switch token.text {
+		case "(":
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		case "[":
+			list := &listNode{}
+			if _, ok := p.accept("]"); ok {
+				return list, nil
+			}
+			for {
+				item, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, item)
+				if _, ok := p.accept("]"); ok {
+					return list, nil
+				}
+				if err = p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+		}
+	case tokenEOF:
+		return nil, errors.New("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", token.text, token.pos)
+}
+
+func (p *exprParser) parseCall(name exprToken) (exprNode, error) {
+	fn, ok := exprFunctions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at %d", name.text, name.pos)
+	}
+	call := &callNode{name: name.text, fn: fn, cache: p.cache}
+	if _, ok := p.accept(")"); ok {
+		return call, nil
+	}
+	for {
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+		if _, ok := p.accept(")"); ok {
+			return call, nil
+		}
+		if err = p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Evaluation
+
+type exprNode interface {
+	eval(env *exprEnv) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(_ *exprEnv) (interface{}, error) {
+	return n.value, nil
+}
+
+type variableNode struct {
+	name string
+}
+
+func (n *variableNode) eval(env *exprEnv) (interface{}, error) {
+	return env.vars[n.name], nil
+}
+
+type listNode struct {
+	items []exprNode
+}
+
+func (n *listNode) eval(env *exprEnv) (interface{}, error) {
+	list := make([]interface{}, 0, len(n.items))
+	for _, item := range n.items {
+		value, err := item.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+// indexNode accesses map fields and list elements; missing values are nil.
+type indexNode struct {
+	target exprNode
+	index  exprNode
+}
+
+func (n *indexNode) eval(env *exprEnv) (interface{}, error) {
+	target, err := n.target.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch t := target.(type) {
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key must be a string, got %T", index)
+		}
+		return t[key], nil
+	case []interface{}:
+		i, ok := index.(float64)
+		if !ok {
+			return nil, fmt.Errorf("list index must be a number, got %T", index)
+		}
+		if int(i) < 0 || int(i) >= len(t) {
+			return nil, nil
+		}
+		return t[int(i)], nil
+	default:
+		return nil, nil
+	}
+}
+
+type notNode struct {
+	operand exprNode
+}
+
+func (n *notNode) eval(env *exprEnv) (interface{}, error) {
+	value, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return !exprTruthy(value), nil
+}
+
+// logicalNode implements short-circuit && and ||.
+type logicalNode struct {
+	or    bool
+	left  exprNode
+	right exprNode
+}
+
+func (n *logicalNode) eval(env *exprEnv) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if exprTruthy(left) == n.or {
+		return n.or, nil
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return exprTruthy(right), nil
+}
+
+type compareNode struct {
+	op    string
+	left  exprNode
+	right exprNode
+	regex *regexp.Regexp // precompiled literal pattern
+	cache *exprCache
+}
+
+func (n *compareNode) eval(env *exprEnv) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return exprEqual(left, right), nil
+	case "!=":
+		return !exprEqual(left, right), nil
+	case "in":
+		return exprContains(right, left), nil
+	case "=~", "!~":
+		regex := n.regex
+		if regex == nil {
+			pattern, ok := right.(string)
+			if !ok {
+				return nil, fmt.Errorf("regular expression must be a string, got %T", right)
+			}
+			regex, err = n.cache.regexp(pattern)
+			if err != nil {
+				return nil, err
+			}
+		}
+		matched := regex.MatchString(exprString(left))
+		return matched == (n.op == "=~"), nil
+	default:
+		return exprOrder(n.op, left, right)
+	}
+}
+
+type callNode struct {
+	name  string
+	fn    exprFunc
+	args  []exprNode
+	cache *exprCache
+}
+
+func (n *callNode) eval(env *exprEnv) (interface{}, error) {
+	args := make([]interface{}, 0, len(n.args))
+	for _, arg := range n.args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, value)
+	}
+	result, err := n.fn(env, n.cache, args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", n.name, err)
+	}
+	return result, nil
+}
+
+// Functions
+
+type exprFunc func(env *exprEnv, cache *exprCache, args []interface{}) (interface{}, error)
+
+var exprFunctions = map[string]exprFunc{
+	"header":     exprHeader,
+	"startsWith": exprStringFunc(strings.HasPrefix),
+	"endsWith":   exprStringFunc(strings.HasSuffix),
+	"contains":   exprContainsFunc,
+	"lower":      exprMapString(strings.ToLower),
+	"upper":      exprMapString(strings.ToUpper),
+	"len":        exprLen,
+	"inCidr":     exprInCidr,
+}
+
+// exprHeader returns the first value of a request header.
+func exprHeader(env *exprEnv, _ *exprCache, args []interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errors.New("expects one argument")
+	}
+	return env.req.Header.Get(exprString(args[0])), nil
+}
+
+func exprStringFunc(fn func(s, arg string) bool) exprFunc {
+	return func(_ *exprEnv, _ *exprCache, args []interface{}) (interface{}, error) {
+		if len(args) != 2 {
+			return nil, errors.New("expects two arguments")
+		}
+		return fn(exprString(args[0]), exprString(args[1])), nil
+	}
+}
+
+func exprMapString(fn func(s string) string) exprFunc {
+	return func(_ *exprEnv, _ *exprCache, args []interface{}) (interface{}, error) {
+		if len(args) != 1 {
+			return nil, errors.New("expects one argument")
+		}
+		return fn(exprString(args[0])), nil
+	}
+}
+
+func exprContainsFunc(_ *exprEnv, _ *exprCache, args []interface{}) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errors.New("expects two arguments")
+	}
+	return exprContains(args[0], args[1]), nil
+}
+
+func exprLen(_ *exprEnv, _ *exprCache, args []interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errors.New("expects one argument")
+	}
+	switch v := args[0].(type) {
+	case string:
+		return float64(len(v)), nil
+	case []interface{}:
+		return float64(len(v)), nil
+	case map[string]interface{}:
+		return float64(len(v)), nil
+	default:
+		return float64(0), nil
+	}
+}
+
+// exprInCidr reports whether the IP is in any of the ranges. Ranges can be
+// strings, comma separated strings or lists.
+func exprInCidr(_ *exprEnv, cache *exprCache, args []interface{}) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, errors.New("expects an ip and at least one range")
+	}
+	ip := net.ParseIP(exprString(args[0]))
+	if ip == nil {
+		return false, nil
+	}
+
+	var ranges []string
+	for _, arg := range args[1:] {
+		ranges = appendExprRanges(ranges, arg)
+	}
+	for _, cidr := range ranges {
+		ipNet, err := cache.cidr(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr: %s %w", cidr, err)
+		}
+		if ipNet.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func appendExprRanges(ranges []string, value interface{}) []string {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			ranges = appendExprRanges(ranges, item)
+		}
+	case string:
+		for _, cidr := range strings.Split(v, ",") {
+			cidr = strings.TrimSpace(cidr)
+			if cidr != "" {
+				ranges = append(ranges, cidr)
+			}
+		}
+	}
+	return ranges
+}
+
+// Value helpers
+
+// exprTruthy converts a value to a boolean. Nil, false, zero and empty values are false.
+func exprTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case float64:
+		return v != 0
+	case []interface{}:
+		return len(v) > 0
+	case map[string]interface{}:
+		return len(v) > 0
+	default:
+		return true
+	}
+}
+
+// exprString formats a value as string; nil is the empty string.
+func exprString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func exprEqual(left, right interface{}) bool {
+	switch left.(type) {
+	case nil:
+		return right == nil
+	case string, bool, float64:
+		return left == right
+	default:
+		return fmt.Sprint(left) == fmt.Sprint(right)
+	}
+}
+
+// exprContains checks list membership, map keys or substrings.
+func exprContains(container, value interface{}) bool {
+	switch c := container.(type) {
+	case []interface{}:
+		for _, item := range c {
+			if exprEqual(item, value) {
+				return true
+			}
+		}
+		return false
+	case map[string]interface{}:
+		_, ok := c[exprString(value)]
+		return ok
+	case string:
+		return strings.Contains(c, exprString(value))
+	default:
+		return false
+	}
+}
+
+func exprOrder(op string, left, right interface{}) (interface{}, error) {
+	var cmp int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare number with %T", right)
+		}
+		switch {
+		case l < r:
+			cmp = -1
+		case l > r:
+			cmp = 1
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("cannot compare string with %T", right)
+		}
+		cmp = strings.Compare(l, r)
+	default:
+		return nil, fmt.Errorf("cannot compare %T", left)
+	}
+
+	switch op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
@@ -0,0 +1,65 @@
+package tlsguard
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExprInit(t *testing.T) {
+	tests := []struct {
+		expr    string
+		store   *externalDataStore
+		wantErr bool
+	}{
+		{expr: `req.method == "GET"`},
+		{expr: `user == "alice"`, wantErr: true},
+		{expr: `dataAge < 60`, wantErr: true},
+		{expr: `dataAge < 60`, store: &externalDataStore{}},
+		{expr: `header("X") =~ "("`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		rule := &RuleExpr{Expr: test.expr, store: test.store}
+		err := rule.Init()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: unexpected error %v", test.expr, err)
+		}
+	}
+}
+
+func TestExprCacheBounded(t *testing.T) {
+	rule := &RuleExpr{Expr: `header("X-Pattern") != "" && "value" =~ header("X-Pattern") || inCidr(ip, header("X-Range"))`}
+	err := rule.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3*maxExprCacheEntries; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Pattern", fmt.Sprintf("^value%d$", i))
+		req.Header.Set("X-Range", fmt.Sprintf("10.%d.%d.0/24", i/256, i%256))
+		rule.Match(req)
+	}
+
+	if len(rule.cache.regexps) > maxExprCacheEntries || len(rule.cache.cidrs) > maxExprCacheEntries {
+		t.Errorf("cache grew to %d patterns and %d ranges", len(rule.cache.regexps), len(rule.cache.cidrs))
+	}
+}
+
+func TestExprErrorLogRateLimited(t *testing.T) {
+	rule := &RuleExpr{Expr: `dataAge > 5`, store: &externalDataStore{}}
+	err := rule.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if rule.Match(httptest.NewRequest("GET", "/", nil)) {
+			t.Fatal("an expression with an error must not match")
+		}
+	}
+	if rule.errSuppressed != 9 {
+		t.Errorf("expected 9 suppressed errors, got %d", rule.errSuppressed)
+	}
+}
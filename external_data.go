@@ -1,72 +1,258 @@
 package tlsguard
 
 import (
-	"crypto/tls"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
 	"io"
+	mathrand "math/rand"
 	"net/http"
 	"os"
 	"strings"
+	"text/template"
+	"time"
 )
 
-// GetExternalData fetches data from an external source.
-func GetExternalData(config ExternalData) (map[string]interface{}, error) {
-	req, err := http.NewRequest(http.MethodGet, config.URL, nil)
+// Define external data fetch defaults
+const (
+	defaultFetchTimeout    = 30 * time.Second
+	defaultMaxBodySize     = 10 << 20
+	defaultRetryDelay      = time.Second
+	maxRetryDelay          = time.Minute
+	defaultExternalRetries = 2
+)
+
+// errNotModified is returned when a conditional fetch finds the data unchanged.
+var errNotModified = errors.New("not modified")
+
+// fetchStatusError is a non-2xx response of an external source.
+type fetchStatusError struct {
+	status int
+}
+
+func (e *fetchStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d %s", e.status, http.StatusText(e.status))
+}
+
+// fetchValidators are the cache validators of the last response of a source.
+type fetchValidators struct {
+	ETag         string
+	LastModified string
+}
+
+// GetExternalData fetches data from an external source and decodes it in the
+// configured format.
+func GetExternalData(config ExternalData) (interface{}, error) {
+	fetched, err := fetchExternalData(config, nil)
 	if err != nil {
 		return nil, err
 	}
+	return parseExternalData(fetched.payload, config)
+}
+
+// fetchedData is a response of an external source. For signed sources, the
+// body and signature are kept to verify the payload again from the cache.
+type fetchedData struct {
+	payload   []byte // verified data, the body unless it is a JWS
+	body      []byte // raw response body
+	signature string // detached signature of the body
+}
+
+// fetchExternalData returns the response of an external source, retrying
+// transient failures with exponential backoff. With validators the request is
+// conditional and errNotModified reports unchanged data; the validators are
+// updated from the response.
+func fetchExternalData(config ExternalData, validators *fetchValidators) (fetchedData, error) {
+	retries := defaultExternalRetries
+	if config.Retries > 0 {
+		retries = config.Retries
+	}
+	delay := defaultRetryDelay
+	if config.RetryDelay != "" {
+		duration, err := time.ParseDuration(config.RetryDelay)
+		if err != nil {
+			return fetchedData{}, fmt.Errorf("error parsing retry delay: %w", err)
+		}
+		delay = duration
+	}
+
+	// One client serves all attempts of the fetch, its connections are closed afterwards
+	client, err := externalHTTPClient(config)
+	if err != nil {
+		return fetchedData{}, err
+	}
+	defer client.CloseIdleConnections()
+
+	for attempt := 0; ; attempt++ {
+		body, header, err := fetchExternalDataOnce(client, config, validators)
+
+		// A rejected OAuth2 token may have been revoked; retry once with a new one
+		var statusErr *fetchStatusError
+		if errors.As(err, &statusErr) && statusErr.status == http.StatusUnauthorized && config.OAuth2.TokenURL != "" {
+			invalidateOAuth2Token(config.OAuth2)
+			body, header, err = fetchExternalDataOnce(client, config, validators)
+		}
+
+		if err == nil && config.Signature.PublicKey != "" {
+			fetched, verifyErr := verifyExternalData(client, config, body, header)
+			if verifyErr != nil {
+				return fetchedData{}, fmt.Errorf("rejected data: %w", verifyErr)
+			}
+			return fetched, nil
+		}
+		if err == nil {
+			return fetchedData{payload: body, body: body}, nil
+		}
+		if attempt >= retries || !retryableFetchError(err) {
+			return fetchedData{}, err
+		}
+
+		// Exponential backoff with jitter between 50% and 150% of the delay
+		wait := time.Duration(float64(delay) * (0.5 + mathrand.Float64()))
+		fmt.Printf("Error fetching %s, retrying in %s: %v\n", config.URL, wait.Round(time.Millisecond), err)
+		time.Sleep(wait)
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// retryableFetchError reports whether a fetch may succeed when repeated:
+// network errors, server errors and rate limiting.
+func retryableFetchError(err error) bool {
+	var statusErr *fetchStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status >= 500 || statusErr.status == http.StatusTooManyRequests
+	}
+	return !errors.Is(err, errNotModified)
+}
+
+// externalHTTPClient returns a client with the timeout and TLS settings of a source.
+func externalHTTPClient(config ExternalData) (*http.Client, error) {
+	timeout := defaultFetchTimeout
+	if config.Timeout != "" {
+		duration, err := time.ParseDuration(config.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing timeout: %w", err)
+		}
+		timeout = duration
+	}
+	tlsConfig, err := externalTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// fetchExternalDataOnce performs a single request with the client and returns
+// the body and headers.
+func fetchExternalDataOnce(client *http.Client, config ExternalData, validators *fetchValidators) ([]byte, http.Header, error) {
+	method, body, contentType, err := externalRequestBody(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	var bodyReader io.Reader
+	if body != "" {
+		bodyReader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, config.URL, bodyReader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
 
 	for key, value := range config.Headers {
 		tval, templateErr := templateValue(value, "")
 		if templateErr != nil {
-			return nil, fmt.Errorf("error in templateValue %s: %w", value, err)
+			return nil, nil, fmt.Errorf("error in templateValue %s: %w", value, templateErr)
 		}
 		req.Header.Set(key, tval)
 	}
+	if validators != nil {
+		if validators.ETag != "" {
+			req.Header.Set("If-None-Match", validators.ETag)
+		}
+		if validators.LastModified != "" {
+			req.Header.Set("If-Modified-Since", validators.LastModified)
+		}
+	}
 
-	client := &http.Client{
-		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: config.SkipTLSVerify}},
+	if config.OAuth2.TokenURL != "" {
+		token, tokenErr := oauth2Token(client, config.OAuth2)
+		if tokenErr != nil {
+			return nil, nil, tokenErr
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
 	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer func() {
 		_ = resp.Body.Close()
 	}()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	if resp.StatusCode == http.StatusNotModified && validators != nil {
+		return nil, nil, errNotModified
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, nil, &fetchStatusError{status: resp.StatusCode}
 	}
 
-	var jsonData map[string]interface{}
-	err = json.Unmarshal(body, &jsonData)
+	maxBodySize := int64(defaultMaxBodySize)
+	if config.MaxBodySize > 0 {
+		maxBodySize = config.MaxBodySize
+	}
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if int64(len(respBody)) > maxBodySize {
+		return nil, nil, fmt.Errorf("response exceeds %d bytes", maxBodySize)
 	}
 
-	return jsonData, nil
+	if validators != nil {
+		validators.ETag = resp.Header.Get("ETag")
+		validators.LastModified = resp.Header.Get("Last-Modified")
+	}
+	return respBody, resp.Header, nil
 }
 
-// templateValue evaluates a template with data.
+// templateFuncs are the functions available in configuration templates.
+var templateFuncs = map[string]interface{}{
+	"file":     getDataFromFile,
+	"env":      getDataFromEnv,
+	"join":     joinValues,
+	"regexAny": regexAny,
+}
+
+// templateValue evaluates a template with data. Values are not HTML escaped,
+// since the results are ranges, patterns and header values, not HTML.
 func templateValue(templateStr string, data any) (string, error) {
-	funcMap := template.FuncMap{
-		"file": getDataFromFile,
-		"env":  getDataFromEnv,
+	result, err := templateRawValue(templateStr, data)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", err, templateStr)
 	}
+	return result, nil
+}
 
-	tmpl, err := template.New("template").Delims("[[", "]]").Funcs(funcMap).Parse(templateStr)
+// templateRawValue evaluates a template like templateValue, without repeating
+// the template in errors, for secrets and PEM data.
+func templateRawValue(templateStr string, data any) (string, error) {
+	tmpl, err := template.New("template").Delims("[[", "]]").Funcs(template.FuncMap(templateFuncs)).Parse(templateStr)
 	if err != nil {
-		return "", fmt.Errorf("error parsing template: %v %w", templateStr, err)
+		return "", fmt.Errorf("error parsing template: %w", err)
 	}
 
 	var result strings.Builder
 	err = tmpl.Execute(&result, data)
 	if err != nil {
-		return "", fmt.Errorf("error executing template: %v %w", templateStr, err)
+		return "", fmt.Errorf("error executing template: %w", err)
 	}
 
 	return result.String(), nil
@@ -0,0 +1,400 @@
+package tlsguard
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// unavailableSourceRetry is how often a source that was never fetched
+// successfully is retried if it has no refresh interval.
+const unavailableSourceRetry = time.Minute
+
+// externalSource is an external data source with its last fetched data.
+type externalSource struct {
+	name     string // empty for the legacy externalData
+	config   ExternalData
+	interval time.Duration // zero fetches only once
+	path     []dataPathStep
+
+	// Guarded by the mutex of the store
+	data      interface{}
+	fetched   bool
+	fetchedAt time.Time // time the data was last confirmed by the source
+	nextFetch time.Time
+
+	// Guarded by the fetch mutex of the store
+	body       []byte // raw response of the data
+	signature  string // detached signature of the body
+	validators fetchValidators
+	fileState  string // names, sizes and modification times of a file source
+}
+
+// fetchResult is the outcome of a successful fetch of a source.
+type fetchResult struct {
+	data      interface{}
+	changed   bool // false if the source confirmed the previous data
+	fetchedAt time.Time
+}
+
+// externalDataStore keeps the data of all external sources across rule
+// refreshes, so a failing source keeps its last data without affecting others.
+// Fetches are serialized by fetchMutex and run without holding mutex, so
+// requests reading the data ages never wait for a slow source.
+type externalDataStore struct {
+	fetchMutex sync.Mutex
+	mutex      sync.Mutex
+	sources    []*externalSource // sorted by name
+	version    int               // incremented whenever the data of a source changes
+}
+
+// newExternalDataStore creates the store for the configured sources. It returns nil without sources.
+func newExternalDataStore(config *Config) (*externalDataStore, error) {
+	if config.ExternalData.URL != "" && len(config.ExternalSources) > 0 {
+		return nil, fmt.Errorf("externalData and externalSources cannot be combined")
+	}
+
+	var defaultInterval time.Duration
+	if config.RefreshInterval != "" {
+		duration, err := time.ParseDuration(config.RefreshInterval)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing refresh interval: %w", err)
+		}
+		defaultInterval = duration
+	}
+
+	store := &externalDataStore{}
+	if config.ExternalData.URL != "" {
+		source, err := newExternalSource("", config.ExternalData, defaultInterval)
+		if err != nil {
+			return nil, err
+		}
+		store.sources = append(store.sources, source)
+	}
+
+	names := make([]string, 0, len(config.ExternalSources))
+	for name := range config.ExternalSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "" {
+			return nil, fmt.Errorf("external source name must not be empty")
+		}
+		source, err := newExternalSource(name, config.ExternalSources[name], defaultInterval)
+		if err != nil {
+			return nil, err
+		}
+		store.sources = append(store.sources, source)
+	}
+
+	if len(store.sources) == 0 {
+		return nil, nil
+	}
+	return store, nil
+}
+
+func newExternalSource(name string, config ExternalData, defaultInterval time.Duration) (*externalSource, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("external source %s: url is required", name)
+	}
+	source := &externalSource{name: name, config: config, interval: defaultInterval}
+	if config.RefreshInterval != "" {
+		duration, err := time.ParseDuration(config.RefreshInterval)
+		if err != nil {
+			return nil, fmt.Errorf("external source %s: error parsing refresh interval: %w", name, err)
+		}
+		source.interval = duration
+	}
+	if _, ok := fileSourcePath(config.URL); ok {
+		err := checkFileSource(config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source.label(), err)
+		}
+		// The refresh interval of the source applies unless pollInterval is set
+		if config.RefreshInterval == "" {
+			source.interval = defaultPollInterval
+		}
+		if config.PollInterval != "" {
+			duration, err := time.ParseDuration(config.PollInterval)
+			if err != nil {
+				return nil, fmt.Errorf("%s: error parsing poll interval: %w", source.label(), err)
+			}
+			source.interval = duration
+		}
+	} else if config.PollInterval != "" {
+		return nil, fmt.Errorf("%s: pollInterval is only supported for file:// sources", source.label())
+	}
+	if config.SkipTLSVerify {
+		fmt.Printf("Warning: skipTlsVerify of %s is deprecated and disables certificate verification, use caFile instead\n", source.label())
+	}
+	_, err := externalTLSConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source.label(), err)
+	}
+	err = checkSignatureVerification(config.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source.label(), err)
+	}
+	err = checkRequestBody(config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source.label(), err)
+	}
+	err = checkOAuth2(config.OAuth2)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source.label(), err)
+	}
+	err = checkDataFormat(config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source.label(), err)
+	}
+	if config.DataPath != "" {
+		if config.DataKey != "" {
+			return nil, fmt.Errorf("%s: dataKey and dataPath cannot be combined", source.label())
+		}
+		path, err := parseDataPath(config.DataPath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", source.label(), err)
+		}
+		source.path = path
+	}
+	return source, nil
+}
+
+// templateData fetches the sources that are due and returns the data for the
+// templates and its version: the legacy source directly, named sources by name.
+// If the legacy source was never fetched successfully, it is an error. A named
+// source that is unavailable has no data and is retried on the next refresh,
+// so the other sources can still be used. Later failures keep the last data.
+func (s *externalDataStore) templateData() (interface{}, int, error) {
+	s.fetchMutex.Lock()
+	defer s.fetchMutex.Unlock()
+
+	now := time.Now()
+	s.mutex.Lock()
+	var due []*externalSource
+	for _, source := range s.sources {
+		if (!source.fetched || source.interval != 0) && !now.Before(source.nextFetch) {
+			due = append(due, source)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, source := range due {
+		result, err := source.fetch()
+
+		s.mutex.Lock()
+		switch {
+		case err != nil && !source.fetched && source.name == "":
+			s.mutex.Unlock()
+			return nil, 0, err
+		case err != nil && !source.fetched:
+			fmt.Printf("%v, retrying on the next refresh\n", err)
+			source.nextFetch = now.Add(source.retryInterval())
+			s.mutex.Unlock()
+			continue
+		case err != nil:
+			fmt.Printf("%v, keeping previous data\n", err)
+		default:
+			if result.changed {
+				source.data = result.data
+				s.version++
+			}
+			source.fetched = true
+			source.fetchedAt = result.fetchedAt
+		}
+		source.nextFetch = now.Add(source.interval)
+		s.mutex.Unlock()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.sources) == 1 && s.sources[0].name == "" {
+		return s.sources[0].data, s.version, nil
+	}
+	data := make(map[string]interface{}, len(s.sources))
+	for _, source := range s.sources {
+		data[source.name] = source.data
+	}
+	return data, s.version, nil
+}
+
+// fetch loads the source. It is called with the fetch mutex held and only
+// changes the fields guarded by it; the result is applied by the caller. The
+// first time, a failed fetch falls back to the cache file.
+func (s *externalSource) fetch() (fetchResult, error) {
+	if path, ok := fileSourcePath(s.config.URL); ok {
+		return s.fetchFile(path)
+	}
+
+	now := time.Now()
+	fetched, err := fetchExternalData(s.config, &s.validators)
+	switch {
+	case errors.Is(err, errNotModified) && s.body != nil:
+		s.writeCache(now)
+		return fetchResult{fetchedAt: now}, nil
+	case err == nil && s.body != nil && bytes.Equal(fetched.body, s.body):
+		s.signature = fetched.signature
+		s.writeCache(now)
+		return fetchResult{fetchedAt: now}, nil
+	case err == nil:
+		var data interface{}
+		data, err = s.decode(fetched.payload)
+		if err == nil {
+			s.body = fetched.body
+			s.signature = fetched.signature
+			s.writeCache(now)
+			return fetchResult{data: data, changed: true, fetchedAt: now}, nil
+		}
+	}
+
+	// Without validators the next fetch downloads the data again
+	s.validators = fetchValidators{}
+	err = fmt.Errorf("error fetching %s: %w", s.label(), err)
+	if s.body != nil || s.config.CacheFile == "" {
+		return fetchResult{}, err
+	}
+	entry, cacheErr := readDataCache(s.config.CacheFile, s.config.URL)
+	payload := entry.Body
+	if cacheErr == nil && s.config.Signature.PublicKey != "" {
+		// The cache is verified like a response, it must not bypass the signature
+		payload, cacheErr = verifySignedData(s.config.Signature, entry.Body, entry.Signature)
+	}
+	var data interface{}
+	if cacheErr == nil {
+		data, cacheErr = s.decode(payload)
+	}
+	if cacheErr != nil {
+		return fetchResult{}, fmt.Errorf("%w; no usable cache: %v", err, cacheErr)
+	}
+	fmt.Printf("%v, using cached data from %s\n", err, entry.FetchedAt.Format(time.RFC3339))
+	s.body = entry.Body
+	s.signature = entry.Signature
+	return fetchResult{data: data, changed: true, fetchedAt: entry.FetchedAt}, nil
+}
+
+// writeCache stores the current response in the cache file if configured.
+func (s *externalSource) writeCache(fetchedAt time.Time) {
+	if s.config.CacheFile == "" {
+		return
+	}
+	err := writeDataCache(s.config.CacheFile, dataCacheEntry{URL: s.config.URL, FetchedAt: fetchedAt, Body: s.body, Signature: s.signature})
+	if err != nil {
+		fmt.Printf("Error writing cache file of %s: %v\n", s.label(), err)
+	}
+}
+
+// decode parses a response body and returns the selected data.
+func (s *externalSource) decode(body []byte) (interface{}, error) {
+	data, err := parseExternalData(body, s.config)
+	if err != nil {
+		return nil, err
+	}
+	return s.selectData(data)
+}
+
+// selectData returns the part of the data selected by dataPath or dataKey.
+func (s *externalSource) selectData(data interface{}) (interface{}, error) {
+	switch {
+	case s.path != nil:
+		return selectDataPath(data, s.path), nil
+	case s.config.DataKey != "":
+		object, ok := data.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("dataKey requires a JSON object")
+		}
+		return object[s.config.DataKey], nil
+	default:
+		return data, nil
+	}
+}
+
+// label names the source in messages.
+func (s *externalSource) label() string {
+	if s.name == "" {
+		return "externalData"
+	}
+	return "external source " + s.name
+}
+
+// retryInterval returns when a source that was never fetched is tried again.
+func (s *externalSource) retryInterval() time.Duration {
+	if s.interval == 0 {
+		return unavailableSourceRetry
+	}
+	return s.interval
+}
+
+// nextUpdate returns the earliest time a source is due. It returns nil if no source refreshes.
+func (s *externalDataStore) nextUpdate() *time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var next *time.Time
+	for _, source := range s.sources {
+		if source.interval == 0 && source.fetched {
+			continue
+		}
+		if next == nil || source.nextFetch.Before(*next) {
+			nextFetch := source.nextFetch
+			next = &nextFetch
+		}
+	}
+	return next
+}
+
+// age returns the age of the data of the named source. It reports false for
+// unknown or never fetched sources.
+func (s *externalDataStore) age(name string) (time.Duration, bool) {
+	if s == nil {
+		return 0, false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, source := range s.sources {
+		if source.name == name && source.fetched {
+			return time.Since(source.fetchedAt), true
+		}
+	}
+	return 0, false
+}
+
+// has reports whether the named source is configured.
+func (s *externalDataStore) has(name string) bool {
+	if s == nil {
+		return false
+	}
+	for _, source := range s.sources {
+		if source.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dataAges returns the data ages in seconds for expressions, shaped like the
+// template data: a number for externalData, a map for named sources.
+func (s *externalDataStore) dataAges() interface{} {
+	if s == nil {
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ages := make(map[string]interface{}, len(s.sources))
+	for _, source := range s.sources {
+		var age interface{}
+		if source.fetched {
+			age = time.Since(source.fetchedAt).Seconds()
+		}
+		if source.name == "" {
+			return age
+		}
+		ages[source.name] = age
+	}
+	return ages
+}
@@ -0,0 +1,227 @@
+package tlsguard
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSlowSourceDoesNotBlockDataAge(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 1 {
+			<-release
+		}
+		_, _ = io.WriteString(rw, `{"ranges": ["192.0.2.0/24"]}`)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	store, err := newExternalDataStore(&Config{ExternalSources: map[string]ExternalData{
+		"slow": {URL: server.URL, RefreshInterval: "1ms"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, version, err := store.templateData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	refreshed := make(chan int)
+	go func() {
+		_, version, _ := store.templateData()
+		refreshed <- version
+	}()
+	for atomic.LoadInt32(&requests) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The refresh is waiting for the server, requests must not wait for it
+	done := make(chan struct{})
+	go func() {
+		store.age("slow")
+		store.dataAges()
+		store.nextUpdate()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reading the data age blocked on the refresh")
+	}
+
+	release <- struct{}{}
+	if got := <-refreshed; got != version {
+		t.Errorf("unchanged data changed the version from %d to %d", version, got)
+	}
+}
+
+func TestFileSourceUnchangedVersion(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newExternalDataStore(&Config{ExternalSources: map[string]ExternalData{
+		"empty": {URL: "file://" + dir, PollInterval: "1ms"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, version, err := store.templateData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	_, got, err := store.templateData()
+	if err != nil || got != version {
+		t.Errorf("unchanged directory changed the version from %d to %d: %v", version, got, err)
+	}
+}
+
+func TestUnavailableSourceAtStartup(t *testing.T) {
+	var down int32 = 1
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/down" && atomic.LoadInt32(&down) == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(rw, `{"ranges": ["192.0.2.0/24"]}`)
+	}))
+	defer server.Close()
+
+	config := CreateConfig()
+	config.ExternalSources = map[string]ExternalData{
+		"healthy": {URL: server.URL + "/healthy"},
+		"down":    {URL: server.URL + "/down", RetryDelay: "1ms"},
+	}
+	config.Rules = []RawRule{{Type: IPRange, Ranges: []string{`[[ join "," .data.healthy.ranges ]]`}}}
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), config, "test")
+	if err != nil {
+		t.Fatalf("an unavailable source must not fail the middleware: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Real-Ip", "192.0.2.1")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("rules from the healthy source were not applied: %d", rw.Code)
+	}
+
+	store := handler.(*TLSGuard).externalData
+	if _, ok := store.age("down"); ok {
+		t.Error("the unavailable source must not be marked as fetched")
+	}
+	next := store.nextUpdate()
+	if next == nil || time.Until(*next) > unavailableSourceRetry {
+		t.Errorf("the unavailable source is not retried, next update %v", next)
+	}
+
+	// The source is fetched once it is due and available
+	atomic.StoreInt32(&down, 0)
+	data, _, err := store.templateData()
+	if err != nil || data.(map[string]interface{})["down"] != nil {
+		t.Errorf("the source was fetched before the retry was due: %v", err)
+	}
+	store.mutex.Lock()
+	for _, source := range store.sources {
+		source.nextFetch = time.Now()
+	}
+	store.mutex.Unlock()
+	data, _, err = store.templateData()
+	if err != nil || data.(map[string]interface{})["down"] == nil {
+		t.Errorf("the source was not fetched after it became available: %v", err)
+	}
+	if _, ok := store.age("down"); !ok {
+		t.Error("the source is not marked as fetched")
+	}
+}
+
+func TestDeniedRequestDoesNotWaitForRefresh(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) > 1 {
+			<-release
+		}
+		_, _ = io.WriteString(rw, `{"ranges": ["192.0.2.0/24"]}`)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	config := CreateConfig()
+	config.ExternalSources = map[string]ExternalData{"net": {URL: server.URL, RefreshInterval: "1ms"}}
+	config.Rules = []RawRule{{Type: IPRange, Ranges: []string{`[[ join "," .data.net.ranges ]]`}}}
+	handler, err := New(context.Background(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}), config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// The refresh hangs on the server, denied requests must still be answered
+	done := make(chan int)
+	go func() {
+		for i := 0; i < 3; i++ {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Real-Ip", "198.51.100.1")
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+			done <- rw.Code
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		select {
+		case code := <-done:
+			if code != http.StatusForbidden {
+				t.Errorf("status %d, want 403", code)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("denied request waited for the refresh")
+		}
+	}
+	if got := atomic.LoadInt32(&handler.(*TLSGuard).updateRunning); got != 1 {
+		t.Errorf("expected one running refresh, got %d", got)
+	}
+}
+
+func TestFetchReusesAndClosesConnections(t *testing.T) {
+	var requests, opened, open int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(rw, `{"ranges": []}`)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt32(&opened, 1)
+			atomic.AddInt32(&open, 1)
+		case http.StateClosed, http.StateHijacked:
+			atomic.AddInt32(&open, -1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	_, err := fetchExternalData(ExternalData{URL: server.URL, RetryDelay: "1ms"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := atomic.LoadInt32(&opened); got != 1 {
+		t.Errorf("%d connections for one fetch with retries, want 1", got)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&open) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&open); got != 0 {
+		t.Errorf("%d connections still open after the fetch", got)
+	}
+}
@@ -0,0 +1,68 @@
+package tlsguard
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// externalTLSConfig builds the TLS configuration of an external source. The
+// CA, certificate and key are templates resulting in PEM data or a file name,
+// and are read on every fetch so rotated files are picked up.
+func externalTLSConfig(config ExternalData) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.SkipTLSVerify,
+	}
+
+	if config.CAFile != "" {
+		caPEM, err := readPEMSetting("caFile", config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("caFile: no certificates found")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		if config.CertFile == "" || config.KeyFile == "" {
+			return nil, fmt.Errorf("certFile and keyFile must be set together")
+		}
+		certPEM, err := readPEMSetting("certFile", config.CertFile)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM, err := readPEMSetting("keyFile", config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// readPEMSetting templates a setting and returns the PEM data it contains or
+// the contents of the file it names.
+func readPEMSetting(name, value string) ([]byte, error) {
+	value, err := templateRawValue(value, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error templating %s: %w", name, err)
+	}
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+	data, err := os.ReadFile(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", name, err)
+	}
+	return data, nil
+}
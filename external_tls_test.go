@@ -0,0 +1,156 @@
+package tlsguard
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// keyPEM returns the PEM encoding of an ECDSA private key.
+func keyPEM(t *testing.T, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+// newMutualTLSServer returns a server for data.example.org that requires a
+// client certificate of the client CA and answers with its common name.
+func newMutualTLSServer(t *testing.T, serverCA, clientCA *testCA) *httptest.Server {
+	t.Helper()
+	cert, key := serverCA.issue(t, "data.example.org", func(template *x509.Certificate) {
+		template.DNSNames = []string{"data.example.org"}
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	})
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCA.cert)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(rw, `{"client": "`+req.TLS.PeerCertificates[0].Subject.CommonName+`"}`)
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestExternalTLS(t *testing.T) {
+	serverCA := newTestCA(t, "server CA")
+	clientCA := newTestCA(t, "client CA")
+	otherCA := newTestCA(t, "other CA")
+	server := newMutualTLSServer(t, serverCA, clientCA)
+
+	clientCert, clientKey := clientCA.issue(t, "tlsguard", nil)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	writeTestFile(t, certFile, certPEM(clientCert))
+	caFile := filepath.Join(dir, "ca.crt")
+	writeTestFile(t, caFile, serverCA.pem())
+	t.Setenv("TLSGUARD_TEST_KEY", keyPEM(t, clientKey))
+	t.Setenv("TLSGUARD_TEST_DIR", dir)
+
+	mutualTLS := ExternalData{
+		URL:        server.URL,
+		CAFile:     serverCA.pem(),
+		ServerName: "data.example.org",
+		CertFile:   certFile,
+		KeyFile:    keyPEM(t, clientKey),
+		Retries:    1,
+		RetryDelay: "1ms",
+	}
+	tests := []struct {
+		name   string
+		adjust func(config *ExternalData)
+		want   string
+	}{
+		{"trusted CA with client certificate", func(config *ExternalData) {}, ""},
+		{"templated files and PEM", func(config *ExternalData) {
+			config.CAFile = `[[ env "TLSGUARD_TEST_DIR" ]]/ca.crt`
+			config.CertFile = `[[ file (print (env "TLSGUARD_TEST_DIR") "/client.crt") ]]`
+			config.KeyFile = `[[ env "TLSGUARD_TEST_KEY" ]]`
+		}, ""},
+		{"system roots", func(config *ExternalData) { config.CAFile = "" }, "unknown authority"},
+		{"untrusted CA", func(config *ExternalData) { config.CAFile = otherCA.pem() }, "unknown authority"},
+		{"server name mismatch", func(config *ExternalData) { config.ServerName = "other.example.org" }, "valid for data.example.org, not other.example.org"},
+		{"without server name", func(config *ExternalData) { config.ServerName = "" }, "IP SANs"},
+		{"without client certificate", func(config *ExternalData) {
+			config.CertFile = ""
+			config.KeyFile = ""
+		}, "certificate required"},
+		// The client only offers certificates of the CAs the server accepts
+		{"client certificate of another CA", func(config *ExternalData) {
+			otherCert, otherKey := otherCA.issue(t, "tlsguard", nil)
+			config.CertFile = certPEM(otherCert)
+			config.KeyFile = keyPEM(t, otherKey)
+		}, "certificate required"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := mutualTLS
+			test.adjust(&config)
+			fetched, err := fetchExternalData(config, nil)
+			if test.want != "" {
+				if err == nil || !strings.Contains(err.Error(), test.want) {
+					t.Errorf("expected an error containing %q, got %v", test.want, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(fetched.payload) != `{"client": "tlsguard"}` {
+				t.Errorf("got %s", fetched.payload)
+			}
+		})
+	}
+}
+
+func TestExternalTLSConfigErrors(t *testing.T) {
+	ca := newTestCA(t, "client CA")
+	cert, key := ca.issue(t, "tlsguard", nil)
+	_, otherKey := ca.issue(t, "other", nil)
+
+	tests := []struct {
+		name   string
+		config ExternalData
+		want   string
+	}{
+		{"certFile without keyFile", ExternalData{CertFile: certPEM(cert)}, "certFile and keyFile must be set together"},
+		{"keyFile without certFile", ExternalData{KeyFile: keyPEM(t, key)}, "certFile and keyFile must be set together"},
+		{"key of another certificate", ExternalData{CertFile: certPEM(cert), KeyFile: keyPEM(t, otherKey)}, "error loading client certificate"},
+		{"caFile without certificates", ExternalData{CAFile: keyPEM(t, key)}, "caFile: no certificates found"},
+		{"missing caFile", ExternalData{CAFile: filepath.Join(t.TempDir(), "missing.crt")}, "error reading caFile"},
+		{"invalid template", ExternalData{CAFile: "[[ env ]]"}, "error templating caFile"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := externalTLSConfig(test.config)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("expected an error containing %q, got %v", test.want, err)
+			}
+		})
+	}
+
+	config, err := externalTLSConfig(ExternalData{ServerName: "data.example.org", CAFile: ca.pem(), CertFile: certPEM(cert), KeyFile: keyPEM(t, key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ServerName != "data.example.org" || config.RootCAs == nil || len(config.Certificates) != 1 || config.InsecureSkipVerify {
+		t.Errorf("unexpected TLS configuration %+v", config)
+	}
+}
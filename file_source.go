@@ -0,0 +1,161 @@
+package tlsguard
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileSourcePrefix marks external data and provider feeds read from the local filesystem.
+const fileSourcePrefix = "file://"
+
+// defaultPollInterval is how often file sources are checked for changes.
+const defaultPollInterval = 5 * time.Second
+
+// fileSourcePath returns the path of a file:// source or feed, or false for other URLs.
+func fileSourcePath(sourceURL string) (string, bool) {
+	if !strings.HasPrefix(sourceURL, fileSourcePrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(sourceURL, fileSourcePrefix), true
+}
+
+// checkFileSource rejects options that only apply to HTTP sources.
+func checkFileSource(config ExternalData) error {
+	switch {
+	case config.Signature.PublicKey != "":
+		return fmt.Errorf("signature is not supported for file sources")
+	case config.OAuth2.TokenURL != "":
+		return fmt.Errorf("oauth2 is not supported for file sources")
+	case config.Body != "" || config.GraphQL.Query != "":
+		return fmt.Errorf("body and graphql are not supported for file sources")
+	case config.CacheFile != "":
+		return fmt.Errorf("cacheFile is not supported for file sources")
+	}
+	return nil
+}
+
+// sourceFiles returns the files of a source: the file itself, or the regular
+// files of a directory in name order without hidden and backup files.
+func sourceFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(name, "~") {
+			continue
+		}
+		fileInfo, err := os.Stat(filepath.Join(path, name))
+		if err != nil || !fileInfo.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, filepath.Join(path, name))
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// fileSourceState describes the files by name, size and modification time, so
+// polling detects changes without reading the files.
+func fileSourceState(path string) (string, error) {
+	files, err := sourceFiles(path)
+	if err != nil {
+		return "", err
+	}
+	var state strings.Builder
+	state.WriteString(path + "\n")
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&state, "%s\x00%d\x00%d\n", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return state.String(), nil
+}
+
+// readFileSource parses the files of a source and merges them in name order.
+func readFileSource(path string, config ExternalData) (interface{}, error) {
+	files, err := sourceFiles(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged interface{}
+	for _, file := range files {
+		body, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		data, err := parseExternalData(body, config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		merged = mergeData(merged, data)
+	}
+	return merged, nil
+}
+
+// mergeData merges objects recursively and concatenates lists; other values
+// of later files replace earlier ones.
+func mergeData(base, overlay interface{}) interface{} {
+	switch o := overlay.(type) {
+	case map[string]interface{}:
+		b, ok := base.(map[string]interface{})
+		if !ok {
+			return o
+		}
+		merged := make(map[string]interface{}, len(b)+len(o))
+		for key, value := range b {
+			merged[key] = value
+		}
+		for key, value := range o {
+			merged[key] = mergeData(merged[key], value)
+		}
+		return merged
+	case []interface{}:
+		b, ok := base.([]interface{})
+		if !ok {
+			return o
+		}
+		return append(append([]interface{}{}, b...), o...)
+	default:
+		return overlay
+	}
+}
+
+// fetchFile reads a file source if its files changed.
+func (s *externalSource) fetchFile(path string) (fetchResult, error) {
+	now := time.Now()
+	state, err := fileSourceState(path)
+	if err != nil {
+		return fetchResult{}, fmt.Errorf("error reading %s: %w", s.label(), err)
+	}
+	if s.fileState != "" && state == s.fileState {
+		return fetchResult{fetchedAt: now}, nil
+	}
+
+	data, err := readFileSource(path, s.config)
+	if err == nil {
+		data, err = s.selectData(data)
+	}
+	if err != nil {
+		return fetchResult{}, fmt.Errorf("error reading %s: %w", s.label(), err)
+	}
+	s.fileState = state
+	return fetchResult{data: data, changed: true, fetchedAt: now}, nil
+}
@@ -0,0 +1,117 @@
+package tlsguard
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// pollFileSource waits past the poll interval and returns the data of the source.
+func pollFileSource(t *testing.T, store *externalDataStore, name string) (interface{}, int) {
+	t.Helper()
+	time.Sleep(5 * time.Millisecond)
+	data, version, err := store.templateData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data.(map[string]interface{})[name], version
+}
+
+func TestFileSourceChanges(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ranges.json")
+	writeTestFile(t, filename, `{"ranges": ["192.0.2.0/24"]}`)
+	store, err := newExternalDataStore(&Config{ExternalSources: map[string]ExternalData{
+		"file": {URL: "file://" + filename, PollInterval: "1ms"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, version := pollFileSource(t, store, "file")
+	if want := map[string]interface{}{"ranges": []interface{}{"192.0.2.0/24"}}; !reflect.DeepEqual(data, want) {
+		t.Fatalf("got %v, want %v", data, want)
+	}
+
+	writeTestFile(t, filename, `{"ranges": ["192.0.2.0/24", "198.51.100.0/24"]}`)
+	data, changed := pollFileSource(t, store, "file")
+	if want := map[string]interface{}{"ranges": []interface{}{"192.0.2.0/24", "198.51.100.0/24"}}; !reflect.DeepEqual(data, want) || changed == version {
+		t.Fatalf("changed file: got %v with version %d, want %v with a new version", data, changed, want)
+	}
+
+	// A file that fails to parse or is removed keeps the previous data
+	writeTestFile(t, filename, `{"ranges": [`)
+	broken, version := pollFileSource(t, store, "file")
+	err = os.Remove(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, got := pollFileSource(t, store, "file")
+	if !reflect.DeepEqual(broken, data) || !reflect.DeepEqual(removed, data) || got != version {
+		t.Errorf("got %v and %v with version %d, want the previous data %v", broken, removed, got, data)
+	}
+}
+
+func TestFileSourceDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "10-office.yaml"), "ranges:\n  - 192.0.2.0/24\nowner: ops\nsites:\n  office: true\n")
+	writeTestFile(t, filepath.Join(dir, "20-vpn.yaml"), "ranges: [198.51.100.0/24]\nowner: netops\nsites:\n  vpn: true\n")
+	writeTestFile(t, filepath.Join(dir, ".hidden.yaml"), "ranges: [0.0.0.0/0]\n")
+	writeTestFile(t, filepath.Join(dir, "20-vpn.yaml~"), "ranges: [0.0.0.0/0]\n")
+	store, err := newExternalDataStore(&Config{ExternalSources: map[string]ExternalData{
+		"partners": {URL: "file://" + dir, Format: FormatYAML, PollInterval: "1ms"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, version := pollFileSource(t, store, "partners")
+	want := map[string]interface{}{
+		"ranges": []interface{}{"192.0.2.0/24", "198.51.100.0/24"},
+		"owner":  "netops",
+		"sites":  map[string]interface{}{"office": true, "vpn": true},
+	}
+	if !reflect.DeepEqual(data, want) {
+		t.Fatalf("got %v, want %v", data, want)
+	}
+
+	// Removing a file of the directory removes its data
+	err = os.Remove(filepath.Join(dir, "20-vpn.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, got := pollFileSource(t, store, "partners")
+	want = map[string]interface{}{
+		"ranges": []interface{}{"192.0.2.0/24"},
+		"owner":  "ops",
+		"sites":  map[string]interface{}{"office": true},
+	}
+	if !reflect.DeepEqual(data, want) || got == version {
+		t.Errorf("got %v with version %d, want %v with a new version", data, got, want)
+	}
+}
+
+func TestFileSourceInterval(t *testing.T) {
+	tests := []struct {
+		name   string
+		config ExternalData
+		want   time.Duration
+	}{
+		{"default", ExternalData{}, defaultPollInterval},
+		{"pollInterval", ExternalData{PollInterval: "2s"}, 2 * time.Second},
+		{"refreshInterval of the source", ExternalData{RefreshInterval: "1m"}, time.Minute},
+		{"pollInterval before refreshInterval", ExternalData{PollInterval: "2s", RefreshInterval: "1m"}, 2 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.URL = "file:///etc/tlsguard/partners.d"
+			source, err := newExternalSource("partners", test.config, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if source.interval != test.want {
+				t.Errorf("interval %s, want %s", source.interval, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package tlsguard
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Define certificate format constants
+const (
+	CertFormatPEM  string = "pem"  // URL-encoded PEM like nginx $ssl_client_escaped_cert
+	CertFormatDER  string = "der"  // base64 encoded DER, comma separated with chain
+	CertFormatXFCC string = "xfcc" // Envoy X-Forwarded-Client-Cert
+
+	defaultForwardCertHeader string = "X-TLSGuard-Client-Cert"
+	xfccHeader               string = "X-Forwarded-Client-Cert"
+)
+
+// ForwardCert configures forwarding the client certificate to the backend.
+type ForwardCert struct {
+	Format string `json:"format,omitempty"` // pem, der or xfcc; empty disables forwarding
+	Header string `json:"header,omitempty"` // defaults to X-TLSGuard-Client-Cert, or X-Forwarded-Client-Cert for xfcc
+	Chain  bool   `json:"chain,omitempty"`  // include the intermediate certificates
+}
+
+// certForwarder adds the client certificate to requests.
+type certForwarder struct {
+	format string
+	header string
+	chain  bool
+}
+
+// newCertForwarder validates the configuration. It returns nil if forwarding is disabled.
+func newCertForwarder(config ForwardCert) (*certForwarder, error) {
+	if config.Format == "" {
+		return nil, nil
+	}
+
+	forwarder := &certForwarder{format: config.Format, header: config.Header, chain: config.Chain}
+	switch config.Format {
+	case CertFormatPEM, CertFormatDER:
+		if forwarder.header == "" {
+			forwarder.header = defaultForwardCertHeader
+		}
+	case CertFormatXFCC:
+		if forwarder.header == "" {
+			forwarder.header = xfccHeader
+		}
+	default:
+		return nil, fmt.Errorf("unknown certificate format: %s", config.Format)
+	}
+	return forwarder, nil
+}
+
+// set adds the encoded certificate to the request.
+func (f *certForwarder) set(req *http.Request, cert *x509.Certificate, chain []*x509.Certificate) {
+	certs := []*x509.Certificate{cert}
+	if f.chain {
+		certs = append(certs, chain...)
+	}
+
+	switch f.format {
+	case CertFormatPEM:
+		req.Header.Set(f.header, escapeCertValue(encodePEM(certs)))
+	case CertFormatDER:
+		encoded := make([]string, 0, len(certs))
+		for _, c := range certs {
+			encoded = append(encoded, base64.StdEncoding.EncodeToString(c.Raw))
+		}
+		req.Header.Set(f.header, strings.Join(encoded, ","))
+	case CertFormatXFCC:
+		req.Header.Set(f.header, encodeXFCC(cert, certs, f.chain))
+	}
+}
+
+// encodePEM returns the certificates as concatenated PEM blocks.
+func encodePEM(certs []*x509.Certificate) string {
+	var output strings.Builder
+	for _, cert := range certs {
+		_ = pem.Encode(&output, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return output.String()
+}
+
+// escapeCertValue URL-encodes a value so that it decodes with both path and
+// query unescaping (spaces become %20, plus signs %2B).
+func escapeCertValue(value string) string {
+	return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+}
+
+// encodeXFCC formats a certificate as an Envoy X-Forwarded-Client-Cert element.
+func encodeXFCC(cert *x509.Certificate, certs []*x509.Certificate, withChain bool) string {
+	hash := sha256.Sum256(cert.Raw)
+	fields := []string{
+		"Hash=" + hex.EncodeToString(hash[:]),
+		"Cert=" + quoteXFCC(escapeCertValue(encodePEM([]*x509.Certificate{cert}))),
+	}
+	if withChain {
+		fields = append(fields, "Chain="+quoteXFCC(escapeCertValue(encodePEM(certs))))
+	}
+	fields = append(fields, "Subject="+quoteXFCC(cert.Subject.String()))
+	for _, uri := range cert.URIs {
+		fields = append(fields, "URI="+quoteXFCC(uri.String()))
+	}
+	for _, dnsName := range cert.DNSNames {
+		fields = append(fields, "DNS="+quoteXFCC(dnsName))
+	}
+	return strings.Join(fields, ";")
+}
+
+// quoteXFCC quotes an XFCC value, escaping backslashes and double quotes.
+func quoteXFCC(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
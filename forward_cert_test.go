@@ -0,0 +1,53 @@
+package tlsguard
+
+import (
+	"bytes"
+	"crypto/x509"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestEncodeXFCCQuotesValues(t *testing.T) {
+	uri, err := url.Parse("spiffe://example.org/ns/a;b,c=d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newTestCert(t, `client "one", ops`, func(template *x509.Certificate) {
+		template.URIs = []*url.URL{uri}
+		template.DNSNames = []string{"client.example.org"}
+	})
+
+	// A proxy appends its element to the one of the previous hop
+	value := `By=spiffe://proxy;Hash=00;URI=spiffe://previous,` + encodeXFCC(cert, []*x509.Certificate{cert}, false)
+	elements := splitXFCC(value, ',')
+	if len(elements) != 2 {
+		t.Fatalf("expected 2 elements, got %d: %q", len(elements), elements)
+	}
+
+	fields := make(map[string][]string)
+	for _, pair := range splitXFCC(elements[1], ';') {
+		key, fieldValue, ok := strings.Cut(pair, "=")
+		if !ok {
+			t.Fatalf("invalid field %q", pair)
+		}
+		fields[key] = append(fields[key], unquoteXFCC(fieldValue))
+	}
+	if got := fields["URI"]; len(got) != 1 || got[0] != uri.String() {
+		t.Errorf("URI is %q, want %q", got, uri.String())
+	}
+	if got := fields["DNS"]; len(got) != 1 || got[0] != "client.example.org" {
+		t.Errorf("DNS is %q", got)
+	}
+	if got := fields["Subject"]; len(got) != 1 || got[0] != cert.Subject.String() {
+		t.Errorf("Subject is %q, want %q", got, cert.Subject.String())
+	}
+
+	certs, err := parseXFCC(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || !bytes.Equal(certs[0].Raw, cert.Raw) {
+		t.Error("parsed certificate does not match")
+	}
+}
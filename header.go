@@ -28,15 +28,23 @@ func (r *RuleHeader) Init() error {
 
 // Match checks if the request headers match the rule.
 func (r *RuleHeader) Match(req *http.Request) bool {
+	return r.MatchTrace(req, nil, "")
+}
+
+// MatchTrace checks if the request headers match the rule and records the result.
+func (r *RuleHeader) MatchTrace(req *http.Request, trace *Trace, path string) bool {
 	for key, regex := range r.allowedHeaders {
 		value := req.Header.Get(key)
 		if len(value) == 0 {
+			trace.addf(path, Header, false, "header %s missing", key)
 			return false
 		}
 		if !regex.MatchString(value) {
+			trace.addf(path, Header, false, "header %s does not match %s", key, regex)
 			return false
 		}
 	}
-	req.Header.Set("X-TLSGuard-Header", "true")
+	getRequestInfo(req).HeaderMatched = true
+	trace.addf(path, Header, true, "all %d headers match", len(r.allowedHeaders))
 	return true
 }
\ No newline at end of file
@@ -0,0 +1,128 @@
+package tlsguard
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Keys of the informational headers added to requests.
+const (
+	HeaderCertSN    string = "certSn"    // serial number of the client certificate, or the no-cert value
+	HeaderCertCN    string = "certCn"    // common name of the client certificate
+	HeaderCidr      string = "cidr"      // range that matched the client IP
+	HeaderHeader    string = "header"    // set to true when a header rule matched
+	HeaderWouldDeny string = "wouldDeny" // reason of a denial not enforced because of report mode
+
+	defaultHeaderPrefix string = "X-TLSGuard-"
+	defaultNoCertValue  string = "NoCert"
+)
+
+// ownedHeaderPrefix is the prefix of all headers TLSGuard sets or reads itself.
+const ownedHeaderPrefix = "x-tlsguard-"
+
+// defaultHeaderSuffixes are appended to the prefix unless a name is configured.
+var defaultHeaderSuffixes = map[string]string{
+	HeaderCertSN:    "Cert-SN",
+	HeaderCertCN:    "Cert-CN",
+	HeaderCidr:      "Cidr",
+	HeaderHeader:    "Header",
+	HeaderWouldDeny: "Would-Deny",
+}
+
+// InfoHeaders configures the names of the informational headers added to requests.
+type InfoHeaders struct {
+	Prefix      string            `json:"prefix,omitempty"`      // prefix of the default names, defaults to X-TLSGuard-
+	Names       map[string]string `json:"names,omitempty"`       // full header name per header key
+	Disabled    []string          `json:"disabled,omitempty"`    // header keys that are not added
+	NoCertValue string            `json:"noCertValue,omitempty"` // certSn value without certificate, defaults to NoCert
+}
+
+// headerEmitter sets the informational headers under their configured names.
+type headerEmitter struct {
+	names       map[string]string // header key -> header name, missing if disabled
+	noCertValue string
+}
+
+// newHeaderEmitter resolves the configured header names.
+func newHeaderEmitter(config InfoHeaders) (*headerEmitter, error) {
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = defaultHeaderPrefix
+	}
+
+	emitter := &headerEmitter{
+		names:       make(map[string]string, len(defaultHeaderSuffixes)),
+		noCertValue: config.NoCertValue,
+	}
+	if emitter.noCertValue == "" {
+		emitter.noCertValue = defaultNoCertValue
+	}
+
+	for key, suffix := range defaultHeaderSuffixes {
+		emitter.names[key] = prefix + suffix
+	}
+	for key, name := range config.Names {
+		if _, ok := defaultHeaderSuffixes[key]; !ok {
+			return nil, fmt.Errorf("unknown header key: %s", key)
+		}
+		emitter.names[key] = name
+	}
+	for _, key := range config.Disabled {
+		if _, ok := defaultHeaderSuffixes[key]; !ok {
+			return nil, fmt.Errorf("unknown header key: %s", key)
+		}
+		delete(emitter.names, key)
+	}
+	return emitter, nil
+}
+
+// set adds the header unless it is disabled.
+func (e *headerEmitter) set(req *http.Request, key, value string) {
+	if name, ok := e.names[key]; ok {
+		req.Header.Set(name, value)
+	}
+}
+
+// newOwnedHeaders returns the canonical names of the headers TLSGuard sets.
+// They are always removed from incoming requests, so the backend only sees the
+// values TLSGuard set. Extra names are headers set by optional features.
+func newOwnedHeaders(config *Config, emitter *headerEmitter, extra ...string) map[string]bool {
+	owned := map[string]bool{http.CanonicalHeaderKey(DebugHeader): true}
+	for _, headerName := range emitter.names {
+		owned[http.CanonicalHeaderKey(headerName)] = true
+	}
+	for _, headerName := range extra {
+		owned[http.CanonicalHeaderKey(headerName)] = true
+	}
+	if config.UsernameHeader != "" {
+		owned[http.CanonicalHeaderKey(config.UsernameHeader)] = true
+	}
+	for headerName := range config.RequestHeaders {
+		owned[http.CanonicalHeaderKey(headerName)] = true
+	}
+	return owned
+}
+
+// newStrippedHeaders returns the canonical names of the additional headers
+// removed by sanitizeHeaders.
+func newStrippedHeaders(config *Config) map[string]bool {
+	stripped := make(map[string]bool, len(config.StripHeaders))
+	for _, headerName := range config.StripHeaders {
+		stripped[http.CanonicalHeaderKey(headerName)] = true
+	}
+	return stripped
+}
+
+// sanitizeHeaders removes client-supplied copies of the headers TLSGuard sets
+// and, if enabled, all other X-TLSGuard-* and the stripHeaders headers, so that
+// spoofed values never reach the backend.
+func (tg *TLSGuard) sanitizeHeaders(req *http.Request) {
+	for headerName := range req.Header {
+		canonical := http.CanonicalHeaderKey(headerName)
+		if tg.ownedHeaders[canonical] || (tg.config.SanitizeHeaders &&
+			(tg.strippedHeaders[canonical] || strings.HasPrefix(strings.ToLower(headerName), ownedHeaderPrefix))) {
+			req.Header.Del(headerName)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package tlsguard
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// spoofedHeaders are sent by a client pretending to be an authenticated user.
+var spoofedHeaders = map[string]string{
+	"X-TLSGuard-Cert-CN":      "mallory",
+	"X-TLSGuard-Cert-SN":      "1",
+	"User":                    "admin",
+	"X-Forwarded-Client-Cert": `Hash=00;Subject="CN=admin"`,
+	"X-Client-Network":        "0.0.0.0/0", // renamed cidr header
+}
+
+func newSanitizeTestGuard(t *testing.T, sanitize bool, backend http.Handler) http.Handler {
+	t.Helper()
+	config := CreateConfig()
+	config.SanitizeHeaders = sanitize
+	config.Users = map[string]string{"alice": "alice"}
+	config.UsernameHeader = "User"
+	config.ForwardCert = ForwardCert{Format: CertFormatXFCC}
+	config.InfoHeaders = InfoHeaders{Names: map[string]string{HeaderCidr: "X-Client-Network"}}
+	config.StripHeaders = []string{"X-Forwarded-User"}
+	config.Rules = []RawRule{{Type: IPRange, Ranges: []string{"192.0.2.0/24"}}}
+
+	handler, err := New(context.Background(), backend, config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handler
+}
+
+func TestSpoofedHeadersNeverReachBackend(t *testing.T) {
+	alice := newTestCert(t, "alice", nil)
+	bob := newTestCert(t, "bob", nil)
+
+	tests := []struct {
+		name string
+		cert func() *http.Request
+		want map[string][]string // values TLSGuard set, nil if absent
+	}{
+		{
+			name: "authenticated user",
+			cert: func() *http.Request {
+				return withClientCert(httptest.NewRequest("GET", "/", nil), alice)
+			},
+			want: map[string][]string{
+				"X-Tlsguard-Cert-Cn":      {"alice"},
+				"X-Tlsguard-Cert-Sn":      {alice.SerialNumber.String()},
+				"User":                    {"alice"},
+				"X-Forwarded-Client-Cert": {encodeXFCC(alice, nil, false)},
+				"X-Client-Network":        nil,
+			},
+		},
+		{
+			name: "unknown certificate allowed by rules",
+			cert: func() *http.Request {
+				return withClientCert(httptest.NewRequest("GET", "/", nil), bob)
+			},
+			want: map[string][]string{
+				"X-Tlsguard-Cert-Cn":      {"bob"},
+				"X-Tlsguard-Cert-Sn":      {bob.SerialNumber.String()},
+				"User":                    nil,
+				"X-Forwarded-Client-Cert": {encodeXFCC(bob, nil, false)},
+				"X-Client-Network":        {"192.0.2.0/24"},
+			},
+		},
+		{
+			name: "no certificate allowed by rules",
+			cert: func() *http.Request {
+				return httptest.NewRequest("GET", "/", nil)
+			},
+			want: map[string][]string{
+				"X-Tlsguard-Cert-Cn":      nil,
+				"X-Tlsguard-Cert-Sn":      {defaultNoCertValue},
+				"User":                    nil,
+				"X-Forwarded-Client-Cert": nil,
+				"X-Client-Network":        {"192.0.2.0/24"},
+			},
+		},
+	}
+
+	for _, sanitize := range []bool{true, false} {
+		for _, test := range tests {
+			backend := &headerRecorder{}
+			handler := newSanitizeTestGuard(t, sanitize, backend)
+
+			req := test.cert()
+			req.Header.Set("X-Real-Ip", "192.0.2.10")
+			for name, value := range spoofedHeaders {
+				req.Header.Add(name, value)
+			}
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			if rw.Code != http.StatusOK || backend.header == nil {
+				t.Fatalf("%s (sanitize %v): request was not forwarded: %d", test.name, sanitize, rw.Code)
+			}
+			for name, want := range test.want {
+				if got := backend.header.Values(name); !reflect.DeepEqual(got, want) {
+					t.Errorf("%s (sanitize %v): %s is %q, want %q", test.name, sanitize, name, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestSanitizeHeadersOption(t *testing.T) {
+	for _, sanitize := range []bool{true, false} {
+		backend := &headerRecorder{}
+		handler := newSanitizeTestGuard(t, sanitize, backend)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Real-Ip", "192.0.2.10")
+		req.Header.Set("X-TLSGuard-Other", "spoofed")
+		req.Header.Set("X-Forwarded-User", "admin")
+		req.Header.Set(DebugHeader, "guess")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		for _, name := range []string{"X-TLSGuard-Other", "X-Forwarded-User"} {
+			if got := backend.header.Get(name); (got == "") != sanitize {
+				t.Errorf("sanitize %v: unexpected %s %q", sanitize, name, got)
+			}
+		}
+		if got := backend.header.Get(DebugHeader); got != "" {
+			t.Errorf("sanitize %v: debug header %q reached the backend", sanitize, got)
+		}
+	}
+}
+
+func TestOwnedHeaders(t *testing.T) {
+	config := &Config{
+		UsernameHeader: "x-user",
+		RequestHeaders: map[string]string{"X-Cert-Email": "[[ .Cert.EmailAddresses ]]"},
+		InfoHeaders:    InfoHeaders{Prefix: "X-Auth-", Disabled: []string{HeaderWouldDeny}},
+	}
+	emitter, err := newHeaderEmitter(config.InfoHeaders)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	owned := newOwnedHeaders(config, emitter, "x-identity-token")
+	for _, name := range []string{"X-User", "X-Cert-Email", "X-Auth-Cert-Cn", "X-Auth-Cidr", "X-Identity-Token", DebugHeader} {
+		if !owned[http.CanonicalHeaderKey(name)] {
+			t.Errorf("%s is not owned", name)
+		}
+	}
+	for name := range owned {
+		if strings.HasSuffix(name, "Would-Deny") {
+			t.Errorf("disabled header %s is owned", name)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package tlsguard
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Define identity token constants
+const (
+	AlgorithmES256 string = "ES256"
+	AlgorithmEdDSA string = "EdDSA"
+	AlgorithmHS256 string = "HS256"
+
+	defaultIdentityHeader     string        = "X-TLSGuard-Identity"
+	defaultIdentityTTL        time.Duration = time.Minute
+	defaultJWKSPath           string        = "/.well-known/tlsguard/jwks.json"
+	identityDecisionAllow     string        = "allow"
+	identityDecisionWouldDeny string        = "wouldDeny"
+)
+
+// IdentityToken configures the signed JWT passed to the backend.
+type IdentityToken struct {
+	Algorithm string `json:"algorithm,omitempty"` // ES256, EdDSA or HS256; empty disables the token
+	KeyFile   string `json:"keyFile,omitempty"`   // PEM private key, or the shared secret for HS256
+	KeyID     string `json:"keyId,omitempty"`     // defaults to the JWK thumbprint of the public key
+	Header    string `json:"header,omitempty"`    // defaults to X-TLSGuard-Identity
+	Issuer    string `json:"issuer,omitempty"`
+	Audience  string `json:"audience,omitempty"`
+	TTL       string `json:"ttl,omitempty"`      // lifetime of the token, defaults to 1m
+	JWKSPath  string `json:"jwksPath,omitempty"` // path serving the public key, defaults to /.well-known/tlsguard/jwks.json
+}
+
+// identitySigner mints identity tokens.
+type identitySigner struct {
+	config    IdentityToken
+	header    string
+	ttl       time.Duration
+	jwksPath  string
+	keyID     string
+	signer    crypto.Signer // nil for HS256
+	secret    []byte
+	jwks      []byte // nil for HS256
+	tokenHead string // encoded JOSE header
+}
+
+// newIdentitySigner loads the signing key. It returns nil if the token is disabled.
+func newIdentitySigner(config IdentityToken) (*identitySigner, error) {
+	if config.Algorithm == "" {
+		return nil, nil
+	}
+	if config.KeyFile == "" {
+		return nil, fmt.Errorf("identityToken: keyFile is required")
+	}
+
+	s := &identitySigner{
+		config:   config,
+		header:   config.Header,
+		ttl:      defaultIdentityTTL,
+		jwksPath: config.JWKSPath,
+		keyID:    config.KeyID,
+	}
+	if s.header == "" {
+		s.header = defaultIdentityHeader
+	}
+	if s.jwksPath == "" {
+		s.jwksPath = defaultJWKSPath
+	}
+	if config.TTL != "" {
+		duration, err := time.ParseDuration(config.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("identityToken: error parsing ttl: %w", err)
+		}
+		s.ttl = duration
+	}
+
+	keyData, err := os.ReadFile(config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("identityToken: error reading key file: %w", err)
+	}
+
+	var jwk map[string]string
+	switch config.Algorithm {
+	case AlgorithmHS256:
+		s.secret = []byte(strings.TrimSpace(string(keyData)))
+		if len(s.secret) < 32 {
+			return nil, fmt.Errorf("identityToken: HS256 secret must be at least 32 bytes")
+		}
+	case AlgorithmES256:
+		key, err := parsePrivateKey(keyData)
+		if err != nil {
+			return nil, fmt.Errorf("identityToken: %w", err)
+		}
+		ecKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok || ecKey.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("identityToken: ES256 requires a P-256 key")
+		}
+		s.signer = ecKey
+		jwk = map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))),
+		}
+	case AlgorithmEdDSA:
+		key, err := parsePrivateKey(keyData)
+		if err != nil {
+			return nil, fmt.Errorf("identityToken: %w", err)
+		}
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("identityToken: EdDSA requires an Ed25519 key")
+		}
+		s.signer = edKey
+		jwk = map[string]string{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   base64.RawURLEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey)),
+		}
+	default:
+		return nil, fmt.Errorf("identityToken: unknown algorithm: %s", config.Algorithm)
+	}
+
+	if jwk != nil {
+		if s.keyID == "" {
+			s.keyID = jwkThumbprint(jwk)
+		}
+		jwk["kid"] = s.keyID
+		jwk["alg"] = config.Algorithm
+		jwk["use"] = "sig"
+		s.jwks, err = json.Marshal(map[string]interface{}{"keys": []map[string]string{jwk}})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	head := map[string]string{"alg": config.Algorithm, "typ": "JWT"}
+	if s.keyID != "" {
+		head["kid"] = s.keyID
+	}
+	headData, err := json.Marshal(head)
+	if err != nil {
+		return nil, err
+	}
+	s.tokenHead = base64.RawURLEncoding.EncodeToString(headData)
+	return s, nil
+}
+
+// parsePrivateKey decodes a PEM encoded PKCS#8 or SEC 1 private key.
+func parsePrivateKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM private key found")
+	}
+	if block.Type == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// jwkThumbprint returns the RFC 7638 thumbprint of a public JWK.
+func jwkThumbprint(jwk map[string]string) string {
+	// json.Marshal sorts the keys as required
+	data, _ := json.Marshal(jwk)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// set adds a token describing the identity of the request.
+func (s *identitySigner) set(req *http.Request, info *requestInfo) {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iat":      now.Unix(),
+		"nbf":      now.Unix(),
+		"exp":      now.Add(s.ttl).Unix(),
+		"jti":      newTokenID(),
+		"decision": identityDecisionAllow,
+	}
+	if ip := clientIP(req); ip != "" {
+		claims["client_ip"] = ip
+	}
+	if s.config.Issuer != "" {
+		claims["iss"] = s.config.Issuer
+	}
+	if s.config.Audience != "" {
+		claims["aud"] = s.config.Audience
+	}
+	if info.Username != "" {
+		claims["sub"] = info.Username
+	}
+	if info.WouldDeny != "" {
+		claims["decision"] = identityDecisionWouldDeny
+		claims["would_deny"] = info.WouldDeny
+	}
+	if info.Cert != nil {
+		sum := sha256.Sum256(info.Cert.Raw)
+		claims["cnf"] = map[string]string{"x5t#S256": base64.RawURLEncoding.EncodeToString(sum[:])}
+		claims["cert_sn"] = info.Cert.SerialNumber.String()
+		if len(info.Cert.Subject.OrganizationalUnit) > 0 {
+			claims["groups"] = info.Cert.Subject.OrganizationalUnit
+		}
+	}
+
+	token, err := s.sign(claims)
+	if err != nil {
+		fmt.Printf("Error signing identity token: %v\n", err)
+		return
+	}
+	req.Header.Set(s.header, token)
+}
+
+// newTokenID returns a random token ID. It is never taken from the request,
+// so clients cannot choose or reuse it.
+func newTokenID() string {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return base64.RawURLEncoding.EncodeToString(id)
+}
+
+// sign encodes and signs the claims as a compact JWS.
+func (s *identitySigner) sign(claims map[string]interface{}) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := s.tokenHead + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch s.config.Algorithm {
+	case AlgorithmHS256:
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case AlgorithmES256:
+		digest := sha256.Sum256([]byte(signingInput))
+		r, sig, err := ecdsa.Sign(rand.Reader, s.signer.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			return "", err
+		}
+		// JWS uses the fixed-size concatenation of r and s
+		signature = append(r.FillBytes(make([]byte, 32)), sig.FillBytes(make([]byte, 32))...)
+	case AlgorithmEdDSA:
+		signature = ed25519.Sign(s.signer.(ed25519.PrivateKey), []byte(signingInput))
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// serveJWKS answers requests for the JWKS document and reports whether it did.
+func (s *identitySigner) serveJWKS(rw http.ResponseWriter, req *http.Request) bool {
+	if s.jwks == nil || req.URL.Path != s.jwksPath {
+		return false
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return true
+	}
+	rw.Header().Set("Content-Type", "application/jwk-set+json")
+	rw.Header().Set("Cache-Control", "public, max-age=300")
+	_, _ = rw.Write(s.jwks)
+	return true
+}
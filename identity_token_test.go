@@ -0,0 +1,203 @@
+package tlsguard
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdentityTokenIDIsRandom(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "secret")
+	writeTestFile(t, keyFile, strings.Repeat("s", 32))
+	signer, err := newIdentitySigner(IdentityToken{Algorithm: AlgorithmHS256, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(requestIDHeader, "chosen-by-client")
+		signer.set(req, &requestInfo{})
+
+		parts := strings.Split(req.Header.Get(defaultIdentityHeader), ".")
+		if len(parts) != 3 {
+			t.Fatalf("invalid token %q", req.Header.Get(defaultIdentityHeader))
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var claims map[string]interface{}
+		err = json.Unmarshal(payload, &claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		jti, _ := claims["jti"].(string)
+		if jti == "" || jti == "chosen-by-client" || seen[jti] {
+			t.Errorf("jti %q must be a new random ID", jti)
+		}
+		seen[jti] = true
+	}
+}
+
+func TestIdentityTokenSignatures(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	keyFiles := map[string]string{
+		AlgorithmES256: filepath.Join(dir, "es256.pem"),
+		AlgorithmEdDSA: filepath.Join(dir, "ed25519.pem"),
+		AlgorithmHS256: filepath.Join(dir, "secret"),
+	}
+	for algorithm, key := range map[string]interface{}{AlgorithmES256: ecKey, AlgorithmEdDSA: edKey} {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestFile(t, keyFiles[algorithm], string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+	}
+	secret := strings.Repeat("k", 40)
+	writeTestFile(t, keyFiles[AlgorithmHS256], secret+"\n")
+
+	for _, algorithm := range []string{AlgorithmES256, AlgorithmEdDSA, AlgorithmHS256} {
+		t.Run(algorithm, func(t *testing.T) {
+			signer, err := newIdentitySigner(IdentityToken{
+				Algorithm: algorithm,
+				KeyFile:   keyFiles[algorithm],
+				Issuer:    "https://tlsguard.example.org",
+				Audience:  "backend",
+				TTL:       "2m",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("GET", "/", nil)
+			before := time.Now().Unix()
+			signer.set(req, &requestInfo{Username: "alice"})
+			parts := strings.Split(req.Header.Get(defaultIdentityHeader), ".")
+			if len(parts) != 3 {
+				t.Fatalf("invalid token %q", req.Header.Get(defaultIdentityHeader))
+			}
+			var head map[string]string
+			decodeTokenPart(t, parts[0], &head)
+			var claims map[string]interface{}
+			decodeTokenPart(t, parts[1], &claims)
+			signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+			if err != nil {
+				t.Fatal(err)
+			}
+			signingInput := []byte(parts[0] + "." + parts[1])
+
+			if head["alg"] != algorithm || head["typ"] != "JWT" {
+				t.Errorf("unexpected header %v", head)
+			}
+			iat, _ := claims["iat"].(float64)
+			exp, _ := claims["exp"].(float64)
+			if int64(iat) < before || int64(iat) > time.Now().Unix() || exp-iat != 120 {
+				t.Errorf("unexpected iat %v and exp %v", claims["iat"], claims["exp"])
+			}
+			if claims["aud"] != "backend" || claims["iss"] != "https://tlsguard.example.org" || claims["sub"] != "alice" {
+				t.Errorf("unexpected claims %v", claims)
+			}
+
+			rw := httptest.NewRecorder()
+			served := signer.serveJWKS(rw, httptest.NewRequest("GET", "/.well-known/tlsguard/jwks.json", nil))
+			if algorithm == AlgorithmHS256 {
+				if served {
+					t.Error("the HS256 secret must not be published")
+				}
+				mac := hmac.New(sha256.New, []byte(secret))
+				mac.Write(signingInput)
+				if !hmac.Equal(signature, mac.Sum(nil)) {
+					t.Error("invalid HS256 signature")
+				}
+				return
+			}
+
+			if !served || rw.Code != 200 {
+				t.Fatalf("JWKS not served: %d", rw.Code)
+			}
+			var jwks struct {
+				Keys []map[string]string `json:"keys"`
+			}
+			err = json.Unmarshal(rw.Body.Bytes(), &jwks)
+			if err != nil || len(jwks.Keys) != 1 {
+				t.Fatalf("invalid JWKS %s: %v", rw.Body.String(), err)
+			}
+			jwk := jwks.Keys[0]
+			if jwk["kid"] != head["kid"] || jwk["alg"] != algorithm {
+				t.Errorf("JWK %v does not match the token header %v", jwk, head)
+			}
+			required := map[string]string{"kty": jwk["kty"], "crv": jwk["crv"], "x": jwk["x"]}
+			if jwk["kty"] == "EC" {
+				required["y"] = jwk["y"]
+			}
+			if thumbprint := jwkThumbprint(required); jwk["kid"] != thumbprint {
+				t.Errorf("kid %s is not the thumbprint %s", jwk["kid"], thumbprint)
+			}
+
+			x := decodeJWKField(t, jwk["x"])
+			verify := func(input []byte) bool {
+				if algorithm == AlgorithmEdDSA {
+					return ed25519.Verify(ed25519.PublicKey(x), input, signature)
+				}
+				publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(decodeJWKField(t, jwk["y"]))}
+				digest := sha256.Sum256(input)
+				return len(signature) == 64 && ecdsa.Verify(publicKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))
+			}
+			if !verify(signingInput) {
+				t.Errorf("invalid %s signature", algorithm)
+			}
+			tampered := append([]byte{}, signingInput...)
+			tampered[len(tampered)-1] ^= 1
+			if verify(tampered) {
+				t.Error("tampered token verified")
+			}
+		})
+	}
+}
+
+// decodeTokenPart decodes a base64url encoded JSON part of a token.
+func decodeTokenPart(t *testing.T, part string, value interface{}) {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = json.Unmarshal(data, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// decodeJWKField decodes a base64url encoded key parameter of a JWK.
+func decodeJWKField(t *testing.T, value string) []byte {
+	t.Helper()
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
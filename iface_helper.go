@@ -5,146 +5,174 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
-// scanInterfaces returns CIDR ranges for network interfaces.
-func scanInterfaces() ([]*net.IPNet, error) {
-	netCidrs := make([]*net.IPNet, 0)
-	ifaceName, err := getDefaultGatewayInterface()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get default gateway interface: %w", err)
-	}
-	fmt.Println("Default Gateway Interface: ", ifaceName)
-	
-	ipv4Ranges, err := getIPv4AddressRanges(ifaceName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get ipv4 address ranges: %w", err)
-	}
-	fmt.Println("IPv4 Address Ranges: ", ipv4Ranges)
-	
-	for _, ipRange := range ipv4Ranges {
-		_, ipNet, iperr := net.ParseCIDR(ipRange)
-		if iperr != nil {
-			return nil, fmt.Errorf("invalid cidr: %s", ipRange)
+const (
+	defaultProcRoot = "/proc"
+
+	// Route flags from linux/route.h
+	routeFlagUp     = 0x0001
+	routeFlagReject = 0x0200
+)
+
+// interfaceOptions selects the network interfaces whose ranges are added to an ipRange rule.
+type interfaceOptions struct {
+	DefaultRoute bool     // interfaces carrying the IPv4 or IPv6 default route
+	Names        []string // interface names or glob patterns like docker* or br-*
+	All          bool     // all non-loopback interfaces
+	ProcRoot     string   // location of the proc filesystem, defaults to /proc
+}
+
+// enabled reports whether any interface selection is configured.
+func (o interfaceOptions) enabled() bool {
+	return o.DefaultRoute || o.All || len(o.Names) > 0
+}
+
+// scanInterfaces returns CIDR ranges for the selected network interfaces.
+func scanInterfaces(opts interfaceOptions) ([]*net.IPNet, error) {
+	selected := make(map[string]bool)
+	if opts.DefaultRoute {
+		procRoot := opts.ProcRoot
+		if procRoot == "" {
+			procRoot = defaultProcRoot
+		}
+		ifaceNames, err := getDefaultGatewayInterfaces(procRoot)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get default gateway interface: %w", err)
+		}
+		fmt.Println("Default Gateway Interfaces: ", ifaceNames)
+		for _, ifaceName := range ifaceNames {
+			selected[ifaceName] = true
 		}
-		netCidrs = append(netCidrs, ipNet)
 	}
-	
-	ipv6Ranges, err := getIPv6AddressRanges(ifaceName)
+
+	interfaces, err := net.Interfaces()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get ipv6 address ranges: %w", err)
+		return nil, err
 	}
-	fmt.Println("IPv6 Address Ranges: ", ipv6Ranges)
-	
-	for _, ipRange := range ipv6Ranges {
-		_, ipNet, err := net.ParseCIDR(ipRange)
+
+	netCidrs := make([]*net.IPNet, 0)
+	for _, iface := range interfaces {
+		if !selected[iface.Name] && !opts.selects(iface) {
+			continue
+		}
+
+		ranges, err := getAddressRanges(iface)
 		if err != nil {
-			return nil, fmt.Errorf("invalid cidr: %s", ipRange)
+			return nil, fmt.Errorf("failed to get address ranges of %s: %w", iface.Name, err)
 		}
-		netCidrs = append(netCidrs, ipNet)
+		fmt.Printf("Address Ranges of %s: %v\n", iface.Name, ranges)
+		netCidrs = append(netCidrs, ranges...)
 	}
 
 	return netCidrs, nil
 }
 
-// getDefaultGatewayInterface returns the name of the default gateway interface.
-func getDefaultGatewayInterface() (string, error) {
-	// Read the /proc/net/route file
-	data, err := os.ReadFile("/proc/net/route")
-	if err != nil {
-		return "", err 
+// selects reports whether the interface is selected by name, pattern or the all option.
+func (o interfaceOptions) selects(iface net.Interface) bool {
+	if o.All && iface.Flags&net.FlagLoopback == 0 {
+		return true
+	}
+	for _, pattern := range o.Names {
+		if matched, _ := path.Match(pattern, iface.Name); matched {
+			return true
+		}
+	}
+	return false
+}
 
+// getDefaultGatewayInterfaces returns the names of the interfaces carrying the
+// IPv4 or IPv6 default route.
+func getDefaultGatewayInterfaces(procRoot string) ([]string, error) {
+	ipv4Ifaces, ipv4Err := getIPv4DefaultRouteInterfaces(filepath.Join(procRoot, "net", "route"))
+	ipv6Ifaces, ipv6Err := getIPv6DefaultRouteInterfaces(filepath.Join(procRoot, "net", "ipv6_route"))
+	if ipv4Err != nil && ipv6Err != nil {
+		return nil, fmt.Errorf("%w; %v", ipv4Err, ipv6Err)
 	}
 
-	// Parse the file to find the default gateway interface
-	lines := strings.Split(string(data), "\n")
-	for _, line := range lines {
-		fields := strings.Split(line, "\t")
-		if len(fields) > 0 && fields[1] == "00000000" && fields[7] == "00000000" {
-			// Found the default gateway, extract the interface name
-			ifaceName := fields[0]
-			return ifaceName, nil
+	ifaceNames := make([]string, 0, len(ipv4Ifaces)+len(ipv6Ifaces))
+	seen := make(map[string]bool)
+	for _, ifaceName := range append(ipv4Ifaces, ipv6Ifaces...) {
+		if !seen[ifaceName] {
+			seen[ifaceName] = true
+			ifaceNames = append(ifaceNames, ifaceName)
 		}
 	}
 
-	return "", errors.New("default gateway interface not found")
+	if len(ifaceNames) == 0 {
+		return nil, errors.New("default gateway interface not found")
+	}
+	return ifaceNames, nil
 }
 
-// getIPv4AddressRanges returns IPv4 address ranges for the specified interface.
-func getIPv4AddressRanges(ifaceName string) ([]string, error) {
-	var ipv4Ranges []string
-	interfaces, err := net.Interfaces()
+// getIPv4DefaultRouteInterfaces parses /proc/net/route for default routes.
+func getIPv4DefaultRouteInterfaces(routeFile string) ([]string, error) {
+	data, err := os.ReadFile(routeFile)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, iface := range interfaces {
-		if iface.Name == ifaceName {
-			addrs, err := iface.Addrs()
-			if err != nil {
-				return nil, err
-			}
-
-			for _, addr := range addrs {
-				var ip net.IP
-				switch v := addr.(type) {
-				case *net.IPNet:
-					ip = v.IP
-				case *net.IPAddr:
-					ip = v.IP
-				}
-
-				if ip.To4() != nil {
-					mask, ok := addr.(*net.IPNet)
-					if ok && mask.IP.To4() != nil {
-						ones, _ := mask.Mask.Size()
-						ipRange := fmt.Sprintf("%s/%v", ip, ones)
-						ipv4Ranges = append(ipv4Ranges, ipRange)
-					}
-				}
-			}
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask MTU Window IRTT
+	var ifaceNames []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 8 {
+			continue
+		}
+		if fields[1] == "00000000" && fields[7] == "00000000" {
+			ifaceNames = append(ifaceNames, fields[0])
 		}
 	}
-
-	return ipv4Ranges, nil
+	return ifaceNames, nil
 }
 
-// getIPv6AddressRanges returns IPv6 address ranges for the specified interface.
-func getIPv6AddressRanges(ifaceName string) ([]string, error) {
-	var ipv6Ranges []string
-	interfaces, err := net.Interfaces()
+// getIPv6DefaultRouteInterfaces parses /proc/net/ipv6_route for default routes.
+func getIPv6DefaultRouteInterfaces(routeFile string) ([]string, error) {
+	data, err := os.ReadFile(routeFile)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, iface := range interfaces {
-		if iface.Name == ifaceName {
-			addrs, err := iface.Addrs()
-			if err != nil {
-				return nil, err
-			}
-
-			for _, addr := range addrs {
-				var ip net.IP
-				switch v := addr.(type) {
-				case *net.IPNet:
-					ip = v.IP
-				case *net.IPAddr:
-					ip = v.IP
-				}
-
-				if ip.To4() == nil {
-					mask, ok := addr.(*net.IPNet)
-					if ok && ip.To16() != nil {
-						ones, _ := mask.Mask.Size()
-						ipRange := fmt.Sprintf("%s/%v", ip, ones)
-						ipv6Ranges = append(ipv6Ranges, ipRange)
-					}
-				}
-			}
+	// Destination PrefixLen Source SourcePrefixLen NextHop Metric RefCnt Use Flags Iface
+	var ifaceNames []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+		if strings.Trim(fields[0], "0") != "" || fields[1] != "00" || fields[9] == "lo" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[8], 16, 32)
+		if err != nil || flags&routeFlagUp == 0 || flags&routeFlagReject != 0 {
+			continue
 		}
+		ifaceNames = append(ifaceNames, fields[9])
 	}
+	return ifaceNames, nil
+}
 
-	return ipv6Ranges, nil
-}
\ No newline at end of file
+// getAddressRanges returns the IPv4 and IPv6 networks of an interface.
+func getAddressRanges(iface net.Interface) ([]*net.IPNet, error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var ranges []*net.IPNet
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ranges = append(ranges, &net.IPNet{
+			IP:   ipNet.IP.Mask(ipNet.Mask),
+			Mask: ipNet.Mask,
+		})
+	}
+	return ranges, nil
+}
@@ -0,0 +1,160 @@
+package tlsguard
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDefaultRouteInterfaces(t *testing.T) {
+	tests := []struct {
+		name     string
+		procRoot string
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "ipv4 and ipv6 with malformed lines",
+			procRoot: filepath.Join("testdata", "proc"),
+			want:     []string{"eth0", "wg0", "eth1"},
+		},
+		{
+			name:     "ipv6 only",
+			procRoot: filepath.Join("testdata", "proc-ipv6only"),
+			want:     []string{"eth1", "eth0"},
+		},
+		{
+			name:     "no default route",
+			procRoot: filepath.Join("testdata", "proc-noroute"),
+			wantErr:  true,
+		},
+		{
+			name:     "missing proc filesystem",
+			procRoot: filepath.Join("testdata", "missing"),
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := getDefaultGatewayInterfaces(test.procRoot)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIPv4DefaultRouteInterfaces(t *testing.T) {
+	got, err := getIPv4DefaultRouteInterfaces(filepath.Join("testdata", "proc", "net", "route"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"eth0", "wg0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestIPv6DefaultRouteInterfaces(t *testing.T) {
+	got, err := getIPv6DefaultRouteInterfaces(filepath.Join("testdata", "proc", "net", "ipv6_route"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lo, the link-local route and the route with invalid flags are skipped
+	if want := []string{"eth1", "eth0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestInterfaceSelection(t *testing.T) {
+	eth0 := net.Interface{Name: "eth0", Flags: net.FlagUp}
+	docker0 := net.Interface{Name: "docker0", Flags: net.FlagUp}
+	bridge := net.Interface{Name: "br-1a2b3c", Flags: net.FlagUp}
+	loopback := net.Interface{Name: "lo", Flags: net.FlagUp | net.FlagLoopback}
+
+	tests := []struct {
+		name  string
+		opts  interfaceOptions
+		iface net.Interface
+		want  bool
+	}{
+		{name: "exact name", opts: interfaceOptions{Names: []string{"eth0"}}, iface: eth0, want: true},
+		{name: "other name", opts: interfaceOptions{Names: []string{"eth1"}}, iface: eth0},
+		{name: "glob", opts: interfaceOptions{Names: []string{"docker*"}}, iface: docker0, want: true},
+		{name: "glob with dash", opts: interfaceOptions{Names: []string{"docker*", "br-*"}}, iface: bridge, want: true},
+		{name: "glob no match", opts: interfaceOptions{Names: []string{"br-*"}}, iface: docker0},
+		{name: "invalid glob", opts: interfaceOptions{Names: []string{"eth["}}, iface: eth0},
+		{name: "all", opts: interfaceOptions{All: true}, iface: bridge, want: true},
+		{name: "all skips loopback", opts: interfaceOptions{All: true}, iface: loopback},
+		{name: "loopback by name", opts: interfaceOptions{Names: []string{"lo"}}, iface: loopback, want: true},
+		{name: "default route only", opts: interfaceOptions{DefaultRoute: true}, iface: eth0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.opts.selects(test.iface); got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestInterfaceOptionsEnabled(t *testing.T) {
+	if (interfaceOptions{ProcRoot: "/proc"}).enabled() {
+		t.Error("options without a selection must be disabled")
+	}
+	for _, opts := range []interfaceOptions{{DefaultRoute: true}, {All: true}, {Names: []string{"eth0"}}} {
+		if !opts.enabled() {
+			t.Errorf("%+v must be enabled", opts)
+		}
+	}
+}
+
+func TestScanInterfaces(t *testing.T) {
+	loopback, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface named lo")
+	}
+	want, err := getAddressRanges(*loopback)
+	if err != nil || len(want) == 0 {
+		t.Skip("loopback interface has no addresses")
+	}
+
+	procRoot := t.TempDir()
+	writeTestFile(t, filepath.Join(procRoot, "net", "route"),
+		"Iface\tDestination\tGateway\tFlags\tRefCnt\tUse\tMetric\tMask\tMTU\tWindow\tIRTT\n"+
+			"lo\t00000000\t00000000\t0001\t0\t0\t0\t00000000\t0\t0\t0\n")
+
+	for _, opts := range []interfaceOptions{
+		{DefaultRoute: true, ProcRoot: procRoot},
+		{Names: []string{"l?"}},
+	} {
+		got, err := scanInterfaces(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%+v: got %v, want %v", opts, got, want)
+		}
+	}
+
+	got, err := scanInterfaces(interfaceOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ipNet := range got {
+		if ipNet.IP.IsLoopback() {
+			t.Errorf("all interfaces must not include loopback range %s", ipNet)
+		}
+	}
+}
@@ -5,15 +5,34 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // RuleIPRange implements a rule that matches client IP addresses.
 type RuleIPRange struct {
-	Ranges       []string `json:"ranges"`
-	AddInterface bool     `json:"addInterface,omitempty"`
+	Ranges        []string          `json:"ranges"`
+	Providers     []IPRangeProvider `json:"providers,omitempty"`
+	AddInterface  bool              `json:"addInterface,omitempty"`
+	Interfaces    []string          `json:"interfaces,omitempty"`
+	AllInterfaces bool              `json:"allInterfaces,omitempty"`
+	ProcRoot      string            `json:"procRoot,omitempty"`
+
+	// InterfaceRefreshInterval re-scans the selected interfaces independently of the config refresh
+	InterfaceRefreshInterval string `json:"interfaceRefreshInterval,omitempty"`
 
 	// Internal
-	allowedCidrs []*net.IPNet
+	allowedCidrs    []*net.IPNet
+	providerCidrs   atomic.Value // []*net.IPNet
+	interfaceCidrs  atomic.Value // []*net.IPNet
+	rescanInterval  time.Duration
+	refreshInterval time.Duration // shortest refresh interval of the providers
+	rescanMutex     sync.Mutex
+	rescanRunning   bool
+	nextRescan      time.Time
+	refreshRunning  bool
+	nextRefresh     time.Time
 }
 
 // Init initializes the rule.
@@ -28,34 +47,165 @@ func (r *RuleIPRange) Init() error {
 		}
 		netCidrs = append(netCidrs, ipNet)
 	}
-	if r.AddInterface {
-		interfaceCidrs, neterr := scanInterfaces()
+	r.allowedCidrs = netCidrs
+
+	for _, provider := range r.Providers {
+		interval, err := provider.refreshInterval()
+		if err != nil {
+			return err
+		}
+		if interval > 0 && (r.refreshInterval == 0 || interval < r.refreshInterval) {
+			r.refreshInterval = interval
+		}
+	}
+	providerCidrs, err := r.fetchProviderCidrs()
+	if err != nil {
+		return err
+	}
+	r.providerCidrs.Store(providerCidrs)
+	r.nextRefresh = time.Now().Add(r.refreshInterval)
+
+	interfaceCidrs := make([]*net.IPNet, 0)
+	ifaceOpts := r.interfaceOptions()
+	if ifaceOpts.enabled() {
+		var neterr error
+		interfaceCidrs, neterr = scanInterfaces(ifaceOpts)
 		if neterr != nil {
 			return neterr
 		}
-		netCidrs = append(netCidrs, interfaceCidrs...)
 	}
+	r.interfaceCidrs.Store(interfaceCidrs)
 
-	r.allowedCidrs = netCidrs
+	if r.InterfaceRefreshInterval != "" {
+		duration, err := time.ParseDuration(r.InterfaceRefreshInterval)
+		if err != nil {
+			return fmt.Errorf("error parsing interface refresh interval: %w", err)
+		}
+		r.rescanInterval = duration
+		r.nextRescan = time.Now().Add(duration)
+	}
 
-	fmt.Println("Allowed CIDRs: ", r.allowedCidrs)
+	fmt.Println("Allowed CIDRs: ", r.allowedCidrs, "Provider CIDRs: ", len(providerCidrs), "Interface CIDRs: ", interfaceCidrs)
 
-	if len(r.allowedCidrs) == 0 {
+	// Interface ranges may appear later when they are re-scanned
+	if len(r.allowedCidrs) == 0 && len(providerCidrs) == 0 && len(interfaceCidrs) == 0 && r.rescanInterval == 0 {
 		return errors.New("no ranges provided")
 	}
 
 	return nil
 }
 
+// fetchProviderCidrs returns the ranges of all providers. The feeds are cached
+// and only downloaded again once their refresh interval has passed.
+func (r *RuleIPRange) fetchProviderCidrs() ([]*net.IPNet, error) {
+	netCidrs := make([]*net.IPNet, 0)
+	for _, provider := range r.Providers {
+		providerRanges, err := provider.fetchRanges()
+		if err != nil {
+			return nil, err
+		}
+		for _, cidr := range providerRanges {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr from provider %s: %s %w", provider.Name, cidr, err)
+			}
+			netCidrs = append(netCidrs, ipNet)
+		}
+	}
+	return netCidrs, nil
+}
+
+// refreshProvidersIfRequired fetches the provider ranges in the background once
+// the refresh interval has passed and swaps in the new ranges.
+func (r *RuleIPRange) refreshProvidersIfRequired() {
+	if r.refreshInterval == 0 {
+		return
+	}
+
+	r.rescanMutex.Lock()
+	if r.refreshRunning || time.Now().Before(r.nextRefresh) {
+		r.rescanMutex.Unlock()
+		return
+	}
+	r.refreshRunning = true
+	r.rescanMutex.Unlock()
+
+	go func() {
+		providerCidrs, err := r.fetchProviderCidrs()
+
+		r.rescanMutex.Lock()
+		defer r.rescanMutex.Unlock()
+		r.refreshRunning = false
+		r.nextRefresh = time.Now().Add(r.refreshInterval)
+		if err != nil {
+			// Keep the previous ranges
+			fmt.Printf("could not refresh provider ranges: %v\n", err)
+			return
+		}
+		r.providerCidrs.Store(providerCidrs)
+	}()
+}
+
+// interfaceOptions returns the interface selection of the rule.
+func (r *RuleIPRange) interfaceOptions() interfaceOptions {
+	return interfaceOptions{
+		DefaultRoute: r.AddInterface,
+		Names:        r.Interfaces,
+		All:          r.AllInterfaces,
+		ProcRoot:     r.ProcRoot,
+	}
+}
+
+// rescanInterfacesIfRequired re-scans the interfaces in the background once the
+// interface refresh interval has passed and swaps in the new ranges.
+func (r *RuleIPRange) rescanInterfacesIfRequired() {
+	if r.rescanInterval == 0 || !r.interfaceOptions().enabled() {
+		return
+	}
+
+	r.rescanMutex.Lock()
+	if r.rescanRunning || time.Now().Before(r.nextRescan) {
+		r.rescanMutex.Unlock()
+		return
+	}
+	r.rescanRunning = true
+	r.rescanMutex.Unlock()
+
+	go func() {
+		interfaceCidrs, err := scanInterfaces(r.interfaceOptions())
+
+		r.rescanMutex.Lock()
+		defer r.rescanMutex.Unlock()
+		r.rescanRunning = false
+		r.nextRescan = time.Now().Add(r.rescanInterval)
+		if err != nil {
+			// Keep the previous ranges
+			fmt.Printf("could not re-scan interfaces: %v\n", err)
+			return
+		}
+		r.interfaceCidrs.Store(interfaceCidrs)
+	}()
+}
+
 // Match checks if the client IP matches any of the allowed ranges.
 func (r *RuleIPRange) Match(req *http.Request) bool {
-	realIP := req.Header.Get("X-Real-Ip")
-	if realIP == "" {
-		realIP = req.Header.Get("X-Forwarded-For")
-	}
-	allowed, cidr := r.isIPInRange(realIP)
+	return r.MatchTrace(req, nil, "")
+}
+
+// MatchTrace checks if the client IP matches any of the allowed ranges and records the result.
+func (r *RuleIPRange) MatchTrace(req *http.Request, trace *Trace, path string) bool {
+	r.rescanInterfacesIfRequired()
+	r.refreshProvidersIfRequired()
+
+	ip := clientIP(req)
+	allowed, cidr := r.isIPInRange(ip)
 	if allowed {
-		req.Header.Set("X-TLSGuard-Cidr", cidr)
+		getRequestInfo(req).MatchedCidr = cidr
+		trace.addf(path, IPRange, true, "IP %s in %s", ip, cidr)
+	} else if trace != nil {
+		providerCidrs, _ := r.providerCidrs.Load().([]*net.IPNet)
+		interfaceCidrs, _ := r.interfaceCidrs.Load().([]*net.IPNet)
+		trace.addf(path, IPRange, false, "IP %q not in %d ranges", ip, len(r.allowedCidrs)+len(providerCidrs)+len(interfaceCidrs))
 	}
 
 	return allowed
@@ -73,5 +223,26 @@ func (r *RuleIPRange) isIPInRange(ip string) (bool, string) {
 			return true, cidr.String()
 		}
 	}
+	providerCidrs, _ := r.providerCidrs.Load().([]*net.IPNet)
+	for _, cidr := range providerCidrs {
+		if cidr.Contains(realIP) {
+			return true, cidr.String()
+		}
+	}
+	interfaceCidrs, _ := r.interfaceCidrs.Load().([]*net.IPNet)
+	for _, cidr := range interfaceCidrs {
+		if cidr.Contains(realIP) {
+			return true, cidr.String()
+		}
+	}
 	return false, ""
-}
\ No newline at end of file
+}
+
+// clientIP returns the client IP from the X-Real-Ip or X-Forwarded-For header.
+func clientIP(req *http.Request) string {
+	realIP := req.Header.Get("X-Real-Ip")
+	if realIP == "" {
+		realIP = req.Header.Get("X-Forwarded-For")
+	}
+	return realIP
+}
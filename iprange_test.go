@@ -0,0 +1,62 @@
+package tlsguard
+
+import (
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInterfaceRescan(t *testing.T) {
+	loopback, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip("no loopback interface named lo")
+	}
+	ranges, err := getAddressRanges(*loopback)
+	if err != nil || len(ranges) == 0 {
+		t.Skip("loopback interface has no addresses")
+	}
+
+	header := "Iface\tDestination\tGateway\tFlags\tRefCnt\tUse\tMetric\tMask\tMTU\tWindow\tIRTT\n"
+	procRoot := t.TempDir()
+	routeFile := filepath.Join(procRoot, "net", "route")
+	writeTestFile(t, routeFile, header+"missing0\t00000000\t00000000\t0001\t0\t0\t0\t00000000\t0\t0\t0\n")
+
+	rule := &RuleIPRange{AddInterface: true, ProcRoot: procRoot, InterfaceRefreshInterval: "1h"}
+	err = rule.Init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Real-Ip", ranges[0].IP.String())
+	if rule.Match(req) {
+		t.Fatal("matched before the interface carried the default route")
+	}
+
+	// The default route moves to the loopback interface
+	writeTestFile(t, routeFile, header+"lo\t00000000\t00000000\t0001\t0\t0\t0\t00000000\t0\t0\t0\n")
+	rule.Match(req)
+	time.Sleep(10 * time.Millisecond)
+	if rule.Match(req) {
+		t.Fatal("re-scanned before the interval passed")
+	}
+
+	rule.rescanMutex.Lock()
+	rule.nextRescan = time.Now()
+	rule.rescanMutex.Unlock()
+	rule.Match(req)
+	for i := 0; i < 100 && !rule.Match(req); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !rule.Match(req) {
+		t.Error("re-scan did not add the ranges of the new default route interface")
+	}
+
+	rule.rescanMutex.Lock()
+	next := rule.nextRescan
+	rule.rescanMutex.Unlock()
+	if time.Until(next) < 59*time.Minute {
+		t.Errorf("next re-scan at %s, want in 1h", next)
+	}
+}
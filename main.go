@@ -9,33 +9,50 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 )
 
 // TLSGuard is the main plugin struct.
 type TLSGuard struct {
-	next           http.Handler
-	name           string
-	config         *Config
-	matchers       *RuleConfig
-	updateMutex    sync.Mutex
-	requestHeaders map[string]*template.Template
+	next            http.Handler
+	name            string
+	config          *Config
+	matchers        *RuleConfig
+	updateMutex     sync.Mutex
+	updateRunning   int32 // 1 while a background refresh runs
+	requestHeaders  map[string]*template.Template
+	debugToken      string
+	denyResponder   *denyResponder
+	ownedHeaders    map[string]bool
+	strippedHeaders map[string]bool
+	headers         *headerEmitter
+	certForwarder   *certForwarder
+	identity        *identitySigner
+	proxyCert       *proxyCertReader
+	externalData    *externalDataStore
 }
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
-	return &Config{}
+	return &Config{
+		SanitizeHeaders: true,
+	}
 }
 
 // New creates a new TLSGuard plugin instance.
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+	// External data is kept across rule refreshes
+	externalData, err := newExternalDataStore(config)
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize rule configuration if rules are present
 	var matchers *RuleConfig
-	var err error
-	
 	if len(config.Rules) > 0 {
-		matchers, err = NewRuleConfig(config)
+		matchers, err = NewRuleConfig(config, externalData)
 		if err != nil {
 			return nil, err
 		}
@@ -56,24 +73,107 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		templates[headerName] = tmpl
 	}
 
+	if config.Mode != "" && config.Mode != ModeEnforce && config.Mode != ModeReport {
+		return nil, fmt.Errorf("unknown mode: %s", config.Mode)
+	}
+
+	debugToken, err := templateValue(config.DebugToken, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error templating debug token: %w", err)
+	}
+
+	responder, err := newDenyResponder(config)
+	if err != nil {
+		return nil, err
+	}
+
+	headers, err := newHeaderEmitter(config.InfoHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	forwarder, err := newCertForwarder(config.ForwardCert)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := newIdentitySigner(config.IdentityToken)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyCert, err := newProxyCertReader(config.ProxyCert)
+	if err != nil {
+		return nil, err
+	}
+
+	// Headers set by optional features are removed from incoming requests
+	var extraHeaders []string
+	if forwarder != nil {
+		extraHeaders = append(extraHeaders, forwarder.header)
+	}
+	if identity != nil {
+		extraHeaders = append(extraHeaders, identity.header)
+	}
+	if proxyCert != nil {
+		extraHeaders = append(extraHeaders, proxyCert.header)
+	}
+
 	return &TLSGuard{
-		next:           next,
-		name:           name,
-		config:         config,
-		matchers:       matchers,
-		requestHeaders: templates,
+		next:            next,
+		name:            name,
+		config:          config,
+		matchers:        matchers,
+		requestHeaders:  templates,
+		debugToken:      strings.TrimSpace(debugToken),
+		denyResponder:   responder,
+		ownedHeaders:    newOwnedHeaders(config, headers, extraHeaders...),
+		strippedHeaders: newStrippedHeaders(config),
+		headers:         headers,
+		certForwarder:   forwarder,
+		identity:        identity,
+		proxyCert:       proxyCert,
+		externalData:    externalData,
 	}, nil
 }
 
 // ServeHTTP implements the http.Handler interface.
 func (tg *TLSGuard) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// Publish the identity token key
+	if tg.identity != nil && tg.identity.serveJWKS(rw, req) {
+		return
+	}
+
+	// Record the decision if requested
+	var trace *Trace
+	debug := tg.traceRequested(req)
+	if debug || tg.config.LogDecisions {
+		trace = &Trace{}
+	}
+
+	// Take the certificate forwarded by a trusted proxy before the header is removed
+	info := getRequestInfo(req)
+	if info.Cert == nil && tg.proxyCert != nil {
+		tg.proxyCert.read(req, info, trace)
+	}
+
+	// Remove spoofed headers, after the debug token has been read
+	tg.sanitizeHeaders(req)
+
+	// Make the identity available to the rules
+	req = withRequestInfo(req, info)
+
 	// Check for TLS client certificate
-	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
-		cert := req.TLS.PeerCertificates[0]
+	if info.Cert != nil {
+		cert := info.Cert
 		
 		// Try user authentication first
 		username, ok := tg.findUserByCert(cert)
 		if ok {
+			info.Username = username
+			trace.addf(traceTypeCertificate, traceTypeCertificate, true, "certificate %s belongs to user %s", cert.Subject.CommonName, username)
+			trace.decide(ActionAllow, "user authenticated by certificate")
+
 			// Set username header if configured
 			if tg.config.UsernameHeader != "" {
 				req.Header.Set(tg.config.UsernameHeader, username)
@@ -81,55 +181,93 @@ func (tg *TLSGuard) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 			
 			// Add certificate headers
 			tg.addCertHeaders(req, cert)
+			tg.addIdentityToken(req, info)
 			
 			// Continue to next handler
+			tg.emitTrace(rw, req, trace, debug)
 			tg.next.ServeHTTP(rw, req)
 			return
 		}
 		
 		// Certificate present but user not found
-		req.Header.Set("X-TLSGuard-Cert-SN", cert.SerialNumber.String())
-		req.Header.Set("X-TLSGuard-Cert-CN", cert.Subject.CommonName)
+		trace.addf(traceTypeCertificate, traceTypeCertificate, false, "no user for certificate %s", cert.Subject.CommonName)
 		tg.addCertHeaders(req, cert)
 	} else {
 		// No certificate provided
-		req.Header.Set("X-TLSGuard-Cert-SN", "NoCert")
+		trace.add(traceTypeCertificate, traceTypeCertificate, false, "no client certificate")
+		tg.headers.set(req, HeaderCertSN, tg.headers.noCertValue)
 	}
 	
 	// If no valid user certificate or no rules defined, check if rules allow access
 	if tg.matchers != nil {
-		allowed := tg.matchers.Match(req)
-		if !allowed {
-			// Check if config needs an update
-			if tg.matchers.NextUpdate != nil && tg.matchers.NextUpdate.Before(time.Now()) {
-				err := tg.updateConfig()
-				if err != nil {
-					fmt.Printf("error updating config: %v", err)
-				}
-				allowed = tg.matchers.Match(req)
-			}
-			
-			if !allowed {
-				http.Error(rw, "Forbidden", http.StatusForbidden)
-				return
+		decision := tg.matchers.Evaluate(req, trace)
+		if !decision.Allowed {
+			// Refresh due rules without letting the request wait for external sources
+			if tg.updateConfigIfRequired() {
+				trace.add(traceTypeRefresh, traceTypeRefresh, true, "rules due, refreshing in the background")
 			}
 		}
-	} else if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		if decision.WouldDeny != "" {
+			tg.reportWouldDeny(req, decision.WouldDeny)
+		}
+
+		if !decision.Allowed && !tg.report(req, trace, decision.Reason) {
+			tg.emitTrace(rw, req, trace, debug)
+			tg.denyResponder.respond(rw, req, denyReason(info))
+			return
+		}
+	} else if info.Cert == nil {
 		// No certificate, no rules, not allowed
-		http.Error(rw, "TLS client certificate is required for authentication", http.StatusForbidden)
-		return
+		trace.decide(ActionDeny, "client certificate required")
+		if !tg.report(req, trace, "client certificate required") {
+			tg.emitTrace(rw, req, trace, debug)
+			tg.denyResponder.respond(rw, req, DenyReasonCertificateRequired)
+			return
+		}
+	} else {
+		trace.decide(ActionAllow, "client certificate present and no rules configured")
 	}
+
+	// Add headers of the matched rules
+	tg.addRuleHeaders(req, info)
 	
 	// Add additional headers if defined
 	tg.addRequestHeaders(req)
+	tg.addIdentityToken(req, info)
 	
 	// Update config if required
 	tg.updateConfigIfRequired()
 	
 	// Continue to next handler
+	tg.emitTrace(rw, req, trace, debug)
 	tg.next.ServeHTTP(rw, req)
 }
 
+// report lets a denied request pass in report mode and reports whether it may pass.
+func (tg *TLSGuard) report(req *http.Request, trace *Trace, reason string) bool {
+	if tg.config.Mode != ModeReport {
+		return false
+	}
+	trace.add(traceTypeMode, traceTypeMode, true, "report mode, request passed on")
+	tg.reportWouldDeny(req, reason)
+	return true
+}
+
+// reportWouldDeny logs a denial that is not enforced and tags the request for the backend.
+func (tg *TLSGuard) reportWouldDeny(req *http.Request, reason string) {
+	fmt.Printf("tlsguard %s: would deny %s %s%s from %s: %s\n",
+		tg.name, req.Method, req.Host, req.URL.Path, clientIP(req), reason)
+	getRequestInfo(req).WouldDeny = reason
+	tg.headers.set(req, HeaderWouldDeny, reason)
+}
+
+// addIdentityToken adds the signed identity token if configured.
+func (tg *TLSGuard) addIdentityToken(req *http.Request, info *requestInfo) {
+	if tg.identity != nil {
+		tg.identity.set(req, info)
+	}
+}
+
 // findUserByCert attempts to find a user based on the certificate.
 func (tg *TLSGuard) findUserByCert(cert *x509.Certificate) (string, bool) {
 	// Check for no users configured case
@@ -186,8 +324,13 @@ func (tg *TLSGuard) findUserByID(userID string) (string, bool) {
 // addCertHeaders adds certificate information to request headers.
 func (tg *TLSGuard) addCertHeaders(req *http.Request, cert *x509.Certificate) {
 	// Add certificate headers
-	req.Header.Set("X-TLSGuard-Cert-SN", cert.SerialNumber.String())
-	req.Header.Set("X-TLSGuard-Cert-CN", cert.Subject.CommonName)
+	tg.headers.set(req, HeaderCertSN, cert.SerialNumber.String())
+	tg.headers.set(req, HeaderCertCN, cert.Subject.CommonName)
+
+	// Forward the certificate if configured
+	if tg.certForwarder != nil {
+		tg.certForwarder.set(req, cert, getRequestInfo(req).Chain)
+	}
 	
 	// Add additional headers if defined as requestHeaders
 	for headerName, tmpl := range tg.requestHeaders {
@@ -204,6 +347,16 @@ func (tg *TLSGuard) addCertHeaders(req *http.Request, cert *x509.Certificate) {
 	}
 }
 
+// addRuleHeaders adds the information recorded by the matched rules.
+func (tg *TLSGuard) addRuleHeaders(req *http.Request, info *requestInfo) {
+	if info.MatchedCidr != "" {
+		tg.headers.set(req, HeaderCidr, info.MatchedCidr)
+	}
+	if info.HeaderMatched {
+		tg.headers.set(req, HeaderHeader, "true")
+	}
+}
+
 // addRequestHeaders adds template-based headers to the request.
 func (tg *TLSGuard) addRequestHeaders(req *http.Request) {
 	for headerName, tmpl := range tg.requestHeaders {
@@ -219,16 +372,23 @@ func (tg *TLSGuard) addRequestHeaders(req *http.Request) {
 	}
 }
 
-// updateConfigIfRequired checks and updates the configuration if needed.
-func (tg *TLSGuard) updateConfigIfRequired() {
-	if tg.matchers != nil && tg.matchers.NextUpdate != nil && tg.matchers.NextUpdate.Before(time.Now()) {
-		go func() {
-			err := tg.updateConfig()
-			if err != nil {
-				fmt.Printf("could not update config %v\n", err)
-			}
-		}()
+// updateConfigIfRequired starts a background refresh of the configuration if
+// it is due and no refresh is running. It reports whether a refresh was started.
+func (tg *TLSGuard) updateConfigIfRequired() bool {
+	if tg.matchers == nil || tg.matchers.NextUpdate == nil || tg.matchers.NextUpdate.After(time.Now()) {
+		return false
+	}
+	if !atomic.CompareAndSwapInt32(&tg.updateRunning, 0, 1) {
+		return false
 	}
+	go func() {
+		defer atomic.StoreInt32(&tg.updateRunning, 0)
+		err := tg.updateConfig()
+		if err != nil {
+			fmt.Printf("could not update config %v\n", err)
+		}
+	}()
+	return true
 }
 
 // updateConfig refreshes the rule configuration.
@@ -240,7 +400,21 @@ func (tg *TLSGuard) updateConfig() error {
 		return nil
 	}
 
-	newMatchers, err := NewRuleConfig(tg.config)
+	// Unchanged external data only needs a new schedule, rules refresh their own ranges
+	if tg.externalData != nil {
+		_, version, err := tg.externalData.templateData()
+		if err == nil && version == tg.matchers.dataVersion {
+			unchanged := *tg.matchers
+			err = unchanged.scheduleUpdate(tg.config, tg.externalData, time.Now())
+			if err != nil {
+				return err
+			}
+			tg.matchers = &unchanged
+			return nil
+		}
+	}
+
+	newMatchers, err := NewRuleConfig(tg.config, tg.externalData)
 	if err != nil {
 		fmt.Println("Error updating matchers: ", err)
 		return err
@@ -0,0 +1,165 @@
+package tlsguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oauth2ExpirySkew renews tokens before they expire.
+const oauth2ExpirySkew = 30 * time.Second
+
+// OAuth2 configures the client credentials flow for an external source.
+type OAuth2 struct {
+	TokenURL     string   `json:"tokenUrl,omitempty"`
+	ClientID     string   `json:"clientId,omitempty"`     // templated, e.g. [[ env "CLIENT_ID" ]]
+	ClientSecret string   `json:"clientSecret,omitempty"` // templated, e.g. [[ file "/run/secrets/client_secret" ]]
+	Scopes       []string `json:"scopes,omitempty"`
+	AuthStyle    string   `json:"authStyle,omitempty"` // header (HTTP Basic, default) or params
+}
+
+// checkOAuth2 validates the OAuth2 configuration of a source.
+func checkOAuth2(config OAuth2) error {
+	if config.TokenURL == "" {
+		return nil
+	}
+	if config.ClientID == "" {
+		return fmt.Errorf("oauth2: clientId is required")
+	}
+	if config.AuthStyle != "" && config.AuthStyle != "header" && config.AuthStyle != "params" {
+		return fmt.Errorf("oauth2: unknown authStyle %s", config.AuthStyle)
+	}
+	return nil
+}
+
+// oauth2CachedToken is an access token with its expiry.
+type oauth2CachedToken struct {
+	accessToken string
+	expiry      time.Time // zero if the token does not expire
+}
+
+// oauth2Tokens caches access tokens per token URL, client and scopes.
+var oauth2Tokens = struct {
+	sync.Mutex
+	tokens map[string]oauth2CachedToken
+}{tokens: make(map[string]oauth2CachedToken)}
+
+// oauth2TokenKey identifies the cached token of a configuration.
+func oauth2TokenKey(config OAuth2) string {
+	return config.TokenURL + "\x00" + config.ClientID + "\x00" + strings.Join(config.Scopes, " ")
+}
+
+// invalidateOAuth2Token removes the cached token of a configuration.
+func invalidateOAuth2Token(config OAuth2) {
+	oauth2Tokens.Lock()
+	defer oauth2Tokens.Unlock()
+	delete(oauth2Tokens.tokens, oauth2TokenKey(config))
+}
+
+// oauth2Token returns a cached access token or requests a new one.
+func oauth2Token(client *http.Client, config OAuth2) (string, error) {
+	key := oauth2TokenKey(config)
+	oauth2Tokens.Lock()
+	defer oauth2Tokens.Unlock()
+
+	cached, ok := oauth2Tokens.tokens[key]
+	if ok && (cached.expiry.IsZero() || time.Now().Before(cached.expiry)) {
+		return cached.accessToken, nil
+	}
+
+	token, err := requestOAuth2Token(client, config)
+	if err != nil {
+		return "", fmt.Errorf("error requesting OAuth2 token: %w", err)
+	}
+	oauth2Tokens.tokens[key] = token
+	return token.accessToken, nil
+}
+
+// requestOAuth2Token performs the client credentials grant.
+func requestOAuth2Token(client *http.Client, config OAuth2) (oauth2CachedToken, error) {
+	var token oauth2CachedToken
+	clientID, err := templateRawValue(config.ClientID, nil)
+	if err != nil {
+		return token, fmt.Errorf("error templating clientId: %w", err)
+	}
+	clientSecret, err := templateRawValue(config.ClientSecret, nil)
+	if err != nil {
+		return token, fmt.Errorf("error templating clientSecret: %w", err)
+	}
+	clientID = strings.TrimSpace(clientID)
+	clientSecret = strings.TrimSpace(clientSecret)
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(config.Scopes) > 0 {
+		form.Set("scope", strings.Join(config.Scopes, " "))
+	}
+	if config.AuthStyle == "params" {
+		form.Set("client_id", clientID)
+		form.Set("client_secret", clientSecret)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return token, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if config.AuthStyle != "params" {
+		req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return token, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return token, err
+	}
+	var response struct {
+		AccessToken      string      `json:"access_token"`
+		TokenType        string      `json:"token_type"`
+		ExpiresIn        json.Number `json:"expires_in"`
+		Error            string      `json:"error"`
+		ErrorDescription string      `json:"error_description"`
+	}
+	err = json.Unmarshal(body, &response)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if err == nil && response.Error != "" {
+			return token, fmt.Errorf("status %d: %s %s", resp.StatusCode, response.Error, response.ErrorDescription)
+		}
+		return token, &fetchStatusError{status: resp.StatusCode}
+	}
+	if err != nil {
+		return token, fmt.Errorf("invalid token response: %w", err)
+	}
+	if response.AccessToken == "" {
+		return token, fmt.Errorf("token response without access_token")
+	}
+	if response.TokenType != "" && !strings.EqualFold(response.TokenType, "bearer") {
+		return token, fmt.Errorf("unsupported token type %s", response.TokenType)
+	}
+
+	token.accessToken = response.AccessToken
+	if response.ExpiresIn != "" {
+		seconds, err := response.ExpiresIn.Int64()
+		if err != nil {
+			return token, fmt.Errorf("invalid expires_in: %w", err)
+		}
+		lifetime := time.Duration(seconds) * time.Second
+		if lifetime > 2*oauth2ExpirySkew {
+			lifetime -= oauth2ExpirySkew
+		}
+		token.expiry = time.Now().Add(lifetime)
+	}
+	return token, nil
+}
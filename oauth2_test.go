@@ -0,0 +1,179 @@
+package tlsguard
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// oauth2TestServer issues tokens at /token and serves data at /data to the
+// latest token only.
+type oauth2TestServer struct {
+	*httptest.Server
+	t         *testing.T
+	mutex     sync.Mutex
+	authStyle string
+	expiresIn int
+	issued    int
+	valid     string
+}
+
+func newOAuth2TestServer(t *testing.T, authStyle string, expiresIn int) *oauth2TestServer {
+	s := &oauth2TestServer{t: t, authStyle: authStyle, expiresIn: expiresIn}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *oauth2TestServer) serveHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch req.URL.Path {
+	case "/token":
+		err := req.ParseForm()
+		if err != nil || req.PostForm.Get("grant_type") != "client_credentials" || req.PostForm.Get("scope") != "read write" {
+			http.Error(rw, `{"error": "invalid_request"}`, http.StatusBadRequest)
+			return
+		}
+		var clientID, clientSecret string
+		if s.authStyle == "params" {
+			clientID, clientSecret = req.PostForm.Get("client_id"), req.PostForm.Get("client_secret")
+		} else {
+			var ok bool
+			clientID, clientSecret, ok = req.BasicAuth()
+			if ok {
+				clientID, _ = url.QueryUnescape(clientID)
+				clientSecret, _ = url.QueryUnescape(clientSecret)
+			}
+		}
+		if clientID != "client:1" || clientSecret != "s3cret&=" {
+			http.Error(rw, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+		s.issued++
+		s.valid = fmt.Sprintf("token-%d", s.issued)
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(rw, `{"access_token": %q, "token_type": "Bearer", "expires_in": %d}`, s.valid, s.expiresIn)
+	case "/data":
+		if req.Header.Get("Authorization") != "Bearer "+s.valid {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = io.WriteString(rw, `{"ranges": ["192.0.2.0/24"]}`)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+// revoke makes the current token invalid for /data.
+func (s *oauth2TestServer) revoke() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.valid = "revoked"
+}
+
+func (s *oauth2TestServer) tokensIssued() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.issued
+}
+
+func (s *oauth2TestServer) source() ExternalData {
+	return ExternalData{
+		URL: s.URL + "/data",
+		OAuth2: OAuth2{
+			TokenURL:     s.URL + "/token",
+			ClientID:     "client:1",
+			ClientSecret: "s3cret&=",
+			Scopes:       []string{"read", "write"},
+			AuthStyle:    s.authStyle,
+		},
+	}
+}
+
+func TestOAuth2TokenCaching(t *testing.T) {
+	for _, authStyle := range []string{"", "header", "params"} {
+		t.Run("authStyle="+authStyle, func(t *testing.T) {
+			server := newOAuth2TestServer(t, authStyle, 3600)
+			for i := 0; i < 2; i++ {
+				_, err := GetExternalData(server.source())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := server.tokensIssued(); got != 1 {
+				t.Errorf("requested %d tokens, want 1", got)
+			}
+		})
+	}
+}
+
+func TestOAuth2TokenRefreshAfterExpiry(t *testing.T) {
+	server := newOAuth2TestServer(t, "header", 3600)
+	config := server.source()
+	_, err := GetExternalData(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := oauth2TokenKey(config.OAuth2)
+	oauth2Tokens.Lock()
+	cached := oauth2Tokens.tokens[key]
+	if cached.expiry.IsZero() || time.Until(cached.expiry) > time.Hour-oauth2ExpirySkew {
+		t.Errorf("expiry %s does not renew the token early", cached.expiry)
+	}
+	cached.expiry = time.Now().Add(-time.Second)
+	oauth2Tokens.tokens[key] = cached
+	oauth2Tokens.Unlock()
+
+	_, err = GetExternalData(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := server.tokensIssued(); got != 2 {
+		t.Errorf("requested %d tokens, want 2", got)
+	}
+}
+
+func TestOAuth2RetryWithNewTokenAfterUnauthorized(t *testing.T) {
+	server := newOAuth2TestServer(t, "params", 3600)
+	config := server.source()
+	_, err := GetExternalData(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached token is still valid by its expiry but the server rejects it
+	server.revoke()
+	data, err := GetExternalData(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data == nil {
+		t.Error("no data after the retry")
+	}
+	if got := server.tokensIssued(); got != 2 {
+		t.Errorf("requested %d tokens, want 2", got)
+	}
+}
+
+func TestOAuth2InvalidClient(t *testing.T) {
+	server := newOAuth2TestServer(t, "header", 3600)
+	config := server.source()
+	config.OAuth2.ClientSecret = "wrong"
+	config.Retries = 1
+	config.RetryDelay = "1ms"
+	_, err := GetExternalData(config)
+	if err == nil {
+		t.Error("expected an error for a rejected client")
+	}
+	if got := server.tokensIssued(); got != 0 {
+		t.Errorf("issued %d tokens to a rejected client", got)
+	}
+}
@@ -0,0 +1,290 @@
+package tlsguard
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Define proxy certificate format constants
+const (
+	CertFormatALB string = "alb" // AWS ALB X-Amzn-Mtls-Clientcert
+
+	albCertHeader string = "X-Amzn-Mtls-Clientcert"
+)
+
+// ProxyCert configures reading the client certificate from a header set by a
+// TLS terminating proxy in front of Traefik.
+type ProxyCert struct {
+	Format         string   `json:"format,omitempty"`         // pem, der, xfcc or alb; empty disables reading
+	Header         string   `json:"header,omitempty"`         // required for pem and der
+	TrustedProxies []string `json:"trustedProxies,omitempty"` // IPs or CIDRs allowed to set the header
+	CAFile         string   `json:"caFile,omitempty"`         // CA the forwarded certificates must chain to, PEM data or file name, templated
+}
+
+// proxyCertReader parses client certificates forwarded by trusted proxies.
+type proxyCertReader struct {
+	format  string
+	header  string
+	proxies []*net.IPNet
+	roots   *x509.CertPool // nil if the chain is not verified
+}
+
+// newProxyCertReader validates the configuration. It returns nil if reading is disabled.
+func newProxyCertReader(config ProxyCert) (*proxyCertReader, error) {
+	if config.Format == "" {
+		return nil, nil
+	}
+
+	reader := &proxyCertReader{format: config.Format, header: config.Header}
+	switch config.Format {
+	case CertFormatPEM, CertFormatDER:
+		if reader.header == "" {
+			return nil, fmt.Errorf("proxyCert: header is required for format %s", config.Format)
+		}
+	case CertFormatXFCC:
+		if reader.header == "" {
+			reader.header = xfccHeader
+		}
+	case CertFormatALB:
+		if reader.header == "" {
+			reader.header = albCertHeader
+		}
+	default:
+		return nil, fmt.Errorf("proxyCert: unknown certificate format: %s", config.Format)
+	}
+	if strings.HasPrefix(strings.ToLower(reader.header), ownedHeaderPrefix) {
+		return nil, fmt.Errorf("proxyCert: header %s is reserved", reader.header)
+	}
+
+	if len(config.TrustedProxies) == 0 {
+		return nil, fmt.Errorf("proxyCert: trustedProxies is required")
+	}
+	for _, proxy := range config.TrustedProxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("proxyCert: invalid trusted proxy: %w", err)
+		}
+		reader.proxies = append(reader.proxies, ipNet)
+	}
+
+	if config.CAFile != "" {
+		caPEM, err := readPEMSetting("caFile", config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("proxyCert: %w", err)
+		}
+		reader.roots = x509.NewCertPool()
+		if !reader.roots.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("proxyCert: caFile: no certificates found")
+		}
+	}
+	return reader, nil
+}
+
+// trusted reports whether the connection comes from a trusted proxy.
+func (r *proxyCertReader) trusted(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range r.proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// read parses the forwarded certificate into the info. Headers from untrusted
+// connections are ignored.
+func (r *proxyCertReader) read(req *http.Request, info *requestInfo, trace *Trace) {
+	value := strings.TrimSpace(req.Header.Get(r.header))
+	if value == "" {
+		return
+	}
+	if !r.trusted(req) {
+		trace.addf(traceTypeCertificate, traceTypeCertificate, false, "ignored forwarded certificate from untrusted %s", req.RemoteAddr)
+		return
+	}
+
+	certs, err := r.parse(value)
+	if err != nil {
+		fmt.Printf("Error parsing forwarded client certificate from %s: %v\n", req.RemoteAddr, err)
+		trace.addf(traceTypeCertificate, traceTypeCertificate, false, "invalid forwarded certificate: %v", err)
+		return
+	}
+	err = r.verify(certs, time.Now())
+	if err != nil {
+		fmt.Printf("Rejected forwarded client certificate from %s: %v\n", req.RemoteAddr, err)
+		trace.addf(traceTypeCertificate, traceTypeCertificate, false, "rejected forwarded certificate: %v", err)
+		return
+	}
+	info.Cert = certs[0]
+	info.Chain = certs[1:]
+	trace.addf(traceTypeCertificate, traceTypeCertificate, true, "certificate %s forwarded by %s", info.Cert.Subject.CommonName, req.RemoteAddr)
+}
+
+// verify checks the validity period of the forwarded certificate and, with a
+// caFile, its chain. The proxy may not have verified the certificate itself.
+func (r *proxyCertReader) verify(certs []*x509.Certificate, now time.Time) error {
+	cert := certs[0]
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("certificate %s is expired or not yet valid", cert.Subject.CommonName)
+	}
+	if r.roots == nil {
+		return nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, chainCert := range certs[1:] {
+		intermediates.AddCert(chainCert)
+	}
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         r.roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
+
+// parse decodes the header value into the leaf certificate and its chain.
+func (r *proxyCertReader) parse(value string) ([]*x509.Certificate, error) {
+	switch r.format {
+	case CertFormatDER:
+		var certs []*x509.Certificate
+		for _, part := range strings.Split(value, ",") {
+			der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(part))
+			if err != nil {
+				return nil, err
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+		return certs, nil
+	case CertFormatXFCC:
+		return parseXFCC(value)
+	default:
+		// nginx and ALB URL-encode the PEM; ALB leaves +, = and / unescaped
+		decoded, err := url.PathUnescape(value)
+		if err != nil {
+			return nil, err
+		}
+		return parsePEMCerts(decoded)
+	}
+}
+
+// parsePEMCerts decodes all certificates of a PEM bundle.
+func parsePEMCerts(data string) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	return certs, nil
+}
+
+// parseXFCC extracts the certificate of the last XFCC element, which was
+// added by the closest proxy. The chain is taken from Chain if present.
+func parseXFCC(value string) ([]*x509.Certificate, error) {
+	elements := splitXFCC(value, ',')
+	fields := make(map[string]string)
+	for _, pair := range splitXFCC(elements[len(elements)-1], ';') {
+		key, fieldValue, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		fields[strings.ToLower(strings.TrimSpace(key))] = unquoteXFCC(strings.TrimSpace(fieldValue))
+	}
+
+	encoded := fields["chain"]
+	if encoded == "" {
+		encoded = fields["cert"]
+	}
+	if encoded == "" {
+		return nil, fmt.Errorf("no Cert field in XFCC element")
+	}
+	decoded, err := url.PathUnescape(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return parsePEMCerts(decoded)
+}
+
+// splitXFCC splits on the separator outside of quoted values.
+func splitXFCC(value string, separator rune) []string {
+	var parts []string
+	var current strings.Builder
+	quoted, escaped := false, false
+	for _, c := range value {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == separator && !quoted:
+			parts = append(parts, current.String())
+			current.Reset()
+			continue
+		}
+		current.WriteRune(c)
+	}
+	return append(parts, current.String())
+}
+
+// unquoteXFCC removes the quotes and escapes of an XFCC value.
+func unquoteXFCC(value string) string {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value
+	}
+	value = value[1 : len(value)-1]
+	var output strings.Builder
+	escaped := false
+	for _, c := range value {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		output.WriteRune(c)
+	}
+	return output.String()
+}
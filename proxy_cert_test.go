@@ -0,0 +1,177 @@
+package tlsguard
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// certPEM returns the PEM encoding of the certificates.
+func certPEM(certs ...*x509.Certificate) string {
+	var output bytes.Buffer
+	for _, cert := range certs {
+		_ = pem.Encode(&output, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return output.String()
+}
+
+// forwardedCertRequest returns a request from the address with the forwarded certificate header.
+func forwardedCertRequest(remoteAddr, header, value string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remoteAddr
+	req.Header.Set(header, value)
+	return req
+}
+
+func TestProxyCertFormats(t *testing.T) {
+	root := newTestCA(t, "root")
+	intermediateCert, intermediateKey := root.issue(t, "intermediate", func(template *x509.Certificate) {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		template.ExtKeyUsage = nil
+	})
+	intermediate := &testCA{cert: intermediateCert, key: intermediateKey}
+	leaf, _ := intermediate.issue(t, "alice", nil)
+
+	tests := []struct {
+		format string
+		header string
+		value  string
+	}{
+		{CertFormatPEM, "X-SSL-Client-Cert", url.PathEscape(certPEM(leaf, intermediateCert))},
+		{CertFormatDER, "X-SSL-Client-Der", base64.StdEncoding.EncodeToString(leaf.Raw) + ", " + base64.StdEncoding.EncodeToString(intermediateCert.Raw)},
+		{CertFormatALB, albCertHeader, strings.NewReplacer("\n", "%0A", " ", "%20").Replace(certPEM(leaf, intermediateCert))},
+		{CertFormatXFCC, xfccHeader, "By=spiffe://proxy;" + encodeXFCC(leaf, []*x509.Certificate{leaf, intermediateCert}, true)},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			header := test.header
+			if test.format == CertFormatALB || test.format == CertFormatXFCC {
+				header = ""
+			}
+			reader, err := newProxyCertReader(ProxyCert{
+				Format:         test.format,
+				Header:         header,
+				TrustedProxies: []string{"10.0.0.0/16", "2001:db8::1"},
+				CAFile:         root.pem(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, remoteAddr := range []string{"10.0.3.4:4711", "[2001:db8::1]:4711"} {
+				info := &requestInfo{}
+				reader.read(forwardedCertRequest(remoteAddr, test.header, test.value), info, nil)
+				if info.Cert == nil || !bytes.Equal(info.Cert.Raw, leaf.Raw) {
+					t.Fatalf("%s: forwarded certificate not read", remoteAddr)
+				}
+				if len(info.Chain) != 1 || !bytes.Equal(info.Chain[0].Raw, intermediateCert.Raw) {
+					t.Errorf("%s: chain not read", remoteAddr)
+				}
+			}
+
+			// The same header from anyone else is ignored
+			info := &requestInfo{}
+			reader.read(forwardedCertRequest("10.1.0.1:4711", test.header, test.value), info, nil)
+			if info.Cert != nil {
+				t.Error("certificate from an untrusted address was read")
+			}
+		})
+	}
+}
+
+func TestProxyCertVerification(t *testing.T) {
+	ca := newTestCA(t, "client CA")
+	valid, _ := ca.issue(t, "alice", nil)
+	expired, _ := ca.issue(t, "alice", func(template *x509.Certificate) {
+		template.NotBefore = time.Now().Add(-48 * time.Hour)
+		template.NotAfter = time.Now().Add(-24 * time.Hour)
+	})
+	notYetValid, _ := ca.issue(t, "alice", func(template *x509.Certificate) {
+		template.NotBefore = time.Now().Add(time.Hour)
+		template.NotAfter = time.Now().Add(2 * time.Hour)
+	})
+	serverCert, _ := ca.issue(t, "alice", func(template *x509.Certificate) {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	})
+	selfSigned := newTestCert(t, "alice", nil)
+
+	tests := []struct {
+		name   string
+		cert   *x509.Certificate
+		caFile string
+		want   bool
+	}{
+		{"issued by the CA", valid, ca.pem(), true},
+		{"self-signed with caFile", selfSigned, ca.pem(), false},
+		{"self-signed without caFile", selfSigned, "", true},
+		{"expired with caFile", expired, ca.pem(), false},
+		{"expired without caFile", expired, "", false},
+		{"not yet valid", notYetValid, "", false},
+		{"server certificate", serverCert, ca.pem(), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader, err := newProxyCertReader(ProxyCert{
+				Format:         CertFormatPEM,
+				Header:         "X-SSL-Client-Cert",
+				TrustedProxies: []string{"10.0.0.1"},
+				CAFile:         test.caFile,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := &requestInfo{}
+			reader.read(forwardedCertRequest("10.0.0.1:4711", "X-SSL-Client-Cert", url.PathEscape(certPEM(test.cert))), info, nil)
+			if got := info.Cert != nil; got != test.want {
+				t.Errorf("accepted %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	_, err := newProxyCertReader(ProxyCert{Format: CertFormatXFCC, TrustedProxies: []string{"10.0.0.1"}, CAFile: "no PEM -----BEGIN"})
+	if err == nil {
+		t.Error("expected an error for a caFile without certificates")
+	}
+}
+
+func TestProxyCertSelfSignedUserDenied(t *testing.T) {
+	ca := newTestCA(t, "client CA")
+	config := CreateConfig()
+	config.Users = map[string]string{"alice": "alice"}
+	config.UsernameHeader = "User"
+	config.ProxyCert = ProxyCert{Format: CertFormatPEM, Header: "X-SSL-Client-Cert", TrustedProxies: []string{"10.0.0.1"}, CAFile: ca.pem()}
+	backend := &headerRecorder{}
+	handler, err := New(context.Background(), backend, config, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issued, _ := ca.issue(t, "alice", nil)
+	for _, test := range []struct {
+		cert *x509.Certificate
+		want int
+	}{
+		{issued, http.StatusOK},
+		{newTestCert(t, "alice", nil), http.StatusForbidden},
+	} {
+		backend.header = nil
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, forwardedCertRequest("10.0.0.1:4711", "X-SSL-Client-Cert", url.PathEscape(certPEM(test.cert))))
+		if rw.Code != test.want {
+			t.Errorf("status %d, want %d", rw.Code, test.want)
+		}
+		if test.want == http.StatusOK && backend.header.Get("User") != "alice" {
+			t.Errorf("user header %q, want alice", backend.header.Get("User"))
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package tlsguard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// GraphQL configures a GraphQL query as the request of an external source.
+type GraphQL struct {
+	Query         string                 `json:"query,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"` // string values are templated
+	OperationName string                 `json:"operationName,omitempty"`
+}
+
+// checkRequestBody validates the method and body options of a source.
+func checkRequestBody(config ExternalData) error {
+	if config.GraphQL.Query != "" && config.Body != "" {
+		return fmt.Errorf("body and graphql cannot be combined")
+	}
+	switch strings.ToUpper(config.Method) {
+	case "", http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodHead, http.MethodOptions:
+	default:
+		return fmt.Errorf("unknown method %s", config.Method)
+	}
+	return nil
+}
+
+// externalRequestBody returns the method, the templated body and its default
+// content type. GraphQL queries are sent as POST with a JSON body.
+func externalRequestBody(config ExternalData) (string, string, string, error) {
+	method := strings.ToUpper(config.Method)
+
+	if config.GraphQL.Query != "" {
+		if method == "" {
+			method = http.MethodPost
+		}
+		variables := make(map[string]interface{}, len(config.GraphQL.Variables))
+		for name, value := range config.GraphQL.Variables {
+			if text, ok := value.(string); ok {
+				templated, err := templateRawValue(text, nil)
+				if err != nil {
+					return "", "", "", fmt.Errorf("error templating graphql variable %s: %w", name, err)
+				}
+				value = templated
+			}
+			variables[name] = value
+		}
+		request := map[string]interface{}{"query": config.GraphQL.Query}
+		if len(variables) > 0 {
+			request["variables"] = variables
+		}
+		if config.GraphQL.OperationName != "" {
+			request["operationName"] = config.GraphQL.OperationName
+		}
+		body, err := json.Marshal(request)
+		if err != nil {
+			return "", "", "", err
+		}
+		return method, string(body), "application/json", nil
+	}
+
+	if method == "" {
+		method = http.MethodGet
+	}
+	if config.Body == "" {
+		return method, "", "", nil
+	}
+	body, err := templateRawValue(config.Body, nil)
+	if err != nil {
+		return "", "", "", fmt.Errorf("error templating body: %w", err)
+	}
+	return method, body, "application/json", nil
+}
+
+// checkGraphQLErrors rejects GraphQL responses that report errors without data.
+func checkGraphQLErrors(data interface{}) error {
+	response, ok := data.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("invalid graphql response")
+	}
+	errorList, _ := response["errors"].([]interface{})
+	if len(errorList) == 0 || response["data"] != nil {
+		return nil
+	}
+	messages := make([]string, 0, len(errorList))
+	for _, entry := range errorList {
+		if object, ok := entry.(map[string]interface{}); ok {
+			messages = append(messages, fmt.Sprint(object["message"]))
+		}
+	}
+	return fmt.Errorf("graphql errors: %s", strings.Join(messages, "; "))
+}
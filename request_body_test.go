@@ -0,0 +1,146 @@
+package tlsguard
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExternalRequestBody(t *testing.T) {
+	t.Setenv("TLSGUARD_TEST_TEAM", "ops")
+	tests := []struct {
+		name        string
+		config      ExternalData
+		method      string
+		body        string
+		contentType string
+	}{
+		{"default GET", ExternalData{}, http.MethodGet, "", ""},
+		{"method is case insensitive", ExternalData{Method: "delete"}, http.MethodDelete, "", ""},
+		{"templated body", ExternalData{Method: "POST", Body: `{"team": "[[ env "TLSGUARD_TEST_TEAM" ]]", "tag": "<ops>"}`}, http.MethodPost, `{"team": "ops", "tag": "<ops>"}`, "application/json"},
+		{"body with the default method", ExternalData{Body: `{}`}, http.MethodGet, `{}`, "application/json"},
+		{"graphql defaults to POST", ExternalData{GraphQL: GraphQL{Query: "{ ranges }"}}, http.MethodPost, `{"query":"{ ranges }"}`, "application/json"},
+		{"graphql with method", ExternalData{Method: "put", GraphQL: GraphQL{Query: "{ ranges }"}}, http.MethodPut, `{"query":"{ ranges }"}`, "application/json"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method, body, contentType, err := externalRequestBody(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if method != test.method || body != test.body || contentType != test.contentType {
+				t.Errorf("got %s %q (%s), want %s %q (%s)", method, body, contentType, test.method, test.body, test.contentType)
+			}
+		})
+	}
+
+	_, _, _, err := externalRequestBody(ExternalData{Body: "[[ env ]]"})
+	if err == nil || !strings.Contains(err.Error(), "error templating body") {
+		t.Errorf("expected a templating error, got %v", err)
+	}
+	_, _, _, err = externalRequestBody(ExternalData{GraphQL: GraphQL{Query: "{ ranges }", Variables: map[string]interface{}{"team": "[[ env ]]"}}})
+	if err == nil || !strings.Contains(err.Error(), "error templating graphql variable team") {
+		t.Errorf("expected a templating error, got %v", err)
+	}
+}
+
+func TestGraphQLRequest(t *testing.T) {
+	t.Setenv("TLSGUARD_TEST_TEAM", "ops")
+	var method, contentType string
+	var request map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		method = req.Method
+		contentType = req.Header.Get("Content-Type")
+		body, _ := io.ReadAll(req.Body)
+		_ = json.Unmarshal(body, &request)
+		_, _ = io.WriteString(rw, `{"data": {"team": {"ranges": ["192.0.2.0/24"]}}}`)
+	}))
+	defer server.Close()
+
+	query := "query Ranges($team: String!, $limit: Int) { team(name: $team) { ranges(limit: $limit) } }"
+	data, err := GetExternalData(ExternalData{
+		URL: server.URL,
+		GraphQL: GraphQL{
+			Query:         query,
+			Variables:     map[string]interface{}{"team": `[[ env "TLSGUARD_TEST_TEAM" ]]`, "limit": 10.0, "active": true},
+			OperationName: "Ranges",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if method != http.MethodPost || contentType != "application/json" {
+		t.Errorf("sent %s with content type %q, want a JSON POST", method, contentType)
+	}
+	want := map[string]interface{}{
+		"query":         query,
+		"variables":     map[string]interface{}{"team": "ops", "limit": 10.0, "active": true},
+		"operationName": "Ranges",
+	}
+	if !reflect.DeepEqual(request, want) {
+		t.Errorf("sent %v, want %v", request, want)
+	}
+	if object, _ := data.(map[string]interface{}); object["data"] == nil {
+		t.Errorf("got %v", data)
+	}
+
+	// A configured Content-Type header replaces the default
+	_, err = GetExternalData(ExternalData{URL: server.URL, Method: "POST", Body: "ranges", Headers: map[string]string{"Content-Type": "text/plain"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "text/plain" {
+		t.Errorf("content type %q, want text/plain", contentType)
+	}
+}
+
+func TestCheckRequestBody(t *testing.T) {
+	tests := []struct {
+		config ExternalData
+		want   string
+	}{
+		{ExternalData{Body: "{}", GraphQL: GraphQL{Query: "{ ranges }"}}, "body and graphql cannot be combined"},
+		{ExternalData{Method: "CONNECT"}, "unknown method CONNECT"},
+		{ExternalData{Method: "FETCH"}, "unknown method FETCH"},
+	}
+	for _, test := range tests {
+		err := checkRequestBody(test.config)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("expected an error containing %q, got %v", test.want, err)
+		}
+	}
+	for _, method := range []string{"", "get", "POST", "Put", "PATCH", "DELETE", "HEAD", "OPTIONS"} {
+		if err := checkRequestBody(ExternalData{Method: method, Body: "{}"}); err != nil {
+			t.Errorf("unexpected error for %s: %v", method, err)
+		}
+	}
+
+	_, err := newExternalDataStore(&Config{ExternalSources: map[string]ExternalData{
+		"ranges": {URL: "https://config.example.org/graphql", Body: "{}", GraphQL: GraphQL{Query: "{ ranges }"}},
+	}})
+	if err == nil || !strings.Contains(err.Error(), "external source ranges: body and graphql cannot be combined") {
+		t.Errorf("expected the source to be rejected, got %v", err)
+	}
+}
+
+func TestCheckGraphQLErrors(t *testing.T) {
+	var response interface{}
+	_ = json.Unmarshal([]byte(`{"errors": [{"message": "unknown team"}, {"message": "forbidden"}]}`), &response)
+	err := checkGraphQLErrors(response)
+	if err == nil || err.Error() != "graphql errors: unknown team; forbidden" {
+		t.Errorf("got %v", err)
+	}
+
+	// Partial data with errors is accepted
+	_ = json.Unmarshal([]byte(`{"data": {"ranges": []}, "errors": [{"message": "partial"}]}`), &response)
+	if err := checkGraphQLErrors(response); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if checkGraphQLErrors([]interface{}{}) == nil {
+		t.Error("expected an error for a response that is not an object")
+	}
+}
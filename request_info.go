@@ -0,0 +1,41 @@
+package tlsguard
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+)
+
+// requestInfo carries the identity established by TLSGuard for rule evaluation
+// and the information recorded by matching rules.
+type requestInfo struct {
+	Cert     *x509.Certificate
+	Chain    []*x509.Certificate // intermediate certificates presented with Cert
+	Username string
+
+	MatchedCidr   string // range of the last matching ipRange rule
+	HeaderMatched bool   // a header rule matched
+	WouldDeny     string // reason of a denial not enforced because of report mode
+}
+
+type requestInfoKey struct{}
+
+// withRequestInfo returns a shallow copy of the request carrying the info.
+func withRequestInfo(req *http.Request, info *requestInfo) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, info))
+}
+
+// getRequestInfo returns the info attached to the request. Without info the
+// client certificate of the TLS connection is used.
+func getRequestInfo(req *http.Request) *requestInfo {
+	if info, ok := req.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+
+	info := &requestInfo{}
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		info.Cert = req.TLS.PeerCertificates[0]
+		info.Chain = req.TLS.PeerCertificates[1:]
+	}
+	return info
+}
@@ -0,0 +1,194 @@
+package tlsguard
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+)
+
+// Define signature type constants
+const (
+	SignatureDetached string = "detached" // Ed25519 signature of the body in a header or at a URL
+	SignatureJWS      string = "jws"      // body is a compact JWS signed with EdDSA or ES256
+
+	defaultSignatureHeader string = "X-Signature"
+)
+
+// SignatureVerification configures verification of external data against a pinned key.
+type SignatureVerification struct {
+	PublicKey string `json:"publicKey,omitempty"` // PEM public key or file name, templated; empty disables verification
+	Type      string `json:"type,omitempty"`      // detached (default) or jws
+	Header    string `json:"header,omitempty"`    // header with the base64 detached signature, defaults to X-Signature
+	URL       string `json:"url,omitempty"`       // fetch the detached signature from this URL instead of a header
+}
+
+// checkSignatureVerification validates the configuration and loads the key.
+func checkSignatureVerification(config SignatureVerification) error {
+	if config.PublicKey == "" {
+		return nil
+	}
+	switch config.Type {
+	case "", SignatureDetached, SignatureJWS:
+	default:
+		return fmt.Errorf("signature: unknown type %s", config.Type)
+	}
+	_, err := loadSignatureKey(config)
+	return err
+}
+
+// loadSignatureKey reads the pinned public key.
+func loadSignatureKey(config SignatureVerification) (interface{}, error) {
+	data, err := readPEMSetting("publicKey", config.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("signature: no PEM public key found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		return k, nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() || config.Type != SignatureJWS {
+			return nil, fmt.Errorf("signature: ECDSA keys must be P-256 and are only supported for jws")
+		}
+		return k, nil
+	default:
+		return nil, fmt.Errorf("signature: unsupported public key type %T", key)
+	}
+}
+
+// verifyExternalData checks the signature of a response and returns it with
+// the verified payload. A signature URL is fetched with the client.
+func verifyExternalData(client *http.Client, config ExternalData, body []byte, header http.Header) (fetchedData, error) {
+	verification := config.Signature
+	var signature string
+	switch {
+	case verification.Type == SignatureJWS:
+	case verification.URL != "":
+		signatureConfig := config
+		signatureConfig.URL = verification.URL
+		signatureConfig.Method = http.MethodGet
+		signatureConfig.Body = ""
+		signatureConfig.GraphQL = GraphQL{}
+		encoded, _, err := fetchExternalDataOnce(client, signatureConfig, nil)
+		if err != nil {
+			return fetchedData{}, fmt.Errorf("error fetching signature: %w", err)
+		}
+		signature = string(encoded)
+	default:
+		headerName := verification.Header
+		if headerName == "" {
+			headerName = defaultSignatureHeader
+		}
+		signature = header.Get(headerName)
+	}
+
+	payload, err := verifySignedData(verification, body, signature)
+	if err != nil {
+		return fetchedData{}, err
+	}
+	return fetchedData{payload: payload, body: body, signature: signature}, nil
+}
+
+// verifySignedData verifies a body with its detached signature, or a JWS body,
+// and returns the payload. It also verifies cached data again when it is read.
+func verifySignedData(verification SignatureVerification, body []byte, signature string) ([]byte, error) {
+	key, err := loadSignatureKey(verification)
+	if err != nil {
+		return nil, err
+	}
+
+	if verification.Type == SignatureJWS {
+		return verifyJWS(strings.TrimSpace(string(body)), key)
+	}
+
+	if strings.TrimSpace(signature) == "" {
+		return nil, fmt.Errorf("signature missing")
+	}
+	decoded, err := decodeSignature(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok || !ed25519.Verify(edKey, body, decoded) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return body, nil
+}
+
+// decodeSignature accepts standard and URL-safe base64 with or without padding.
+func decodeSignature(encoded string) ([]byte, error) {
+	encoded = strings.TrimRight(strings.TrimSpace(encoded), "=")
+	encoded = strings.NewReplacer("+", "-", "/", "_").Replace(encoded)
+	signature, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	return signature, nil
+}
+
+// verifyJWS verifies a compact JWS and returns its payload.
+func verifyJWS(token string, key interface{}) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid JWS: expected 3 parts")
+	}
+	headerData, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWS header: %w", err)
+	}
+	var header struct {
+		Alg  string   `json:"alg"`
+		Crit []string `json:"crit"`
+	}
+	err = json.Unmarshal(headerData, &header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWS header: %w", err)
+	}
+	if len(header.Crit) > 0 {
+		return nil, fmt.Errorf("unsupported critical JWS headers: %v", header.Crit)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWS signature: %w", err)
+	}
+
+	signingInput := []byte(parts[0] + "." + parts[1])
+	valid := false
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		valid = header.Alg == AlgorithmEdDSA && ed25519.Verify(k, signingInput, signature)
+	case *ecdsa.PublicKey:
+		if header.Alg == AlgorithmES256 && len(signature) == 64 {
+			digest := sha256.Sum256(signingInput)
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			valid = ecdsa.Verify(k, digest[:], r, s)
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid JWS signature (alg %s)", header.Alg)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWS payload: %w", err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,321 @@
+package tlsguard
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// publicKeyPEM returns the PEM encoding of a public key.
+func publicKeyPEM(t *testing.T, key interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// signJWS returns a compact JWS of the payload with the header, signed with an
+// Ed25519 or P-256 key.
+func signJWS(t *testing.T, header, payload string, key interface{}) string {
+	t.Helper()
+	input := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(payload))
+	var signature []byte
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(k, []byte(input))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(input))
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyDetachedSignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`{"ranges": ["192.0.2.0/24"]}`)
+	signature := ed25519.Sign(privateKey, body)
+
+	tests := []struct {
+		name      string
+		key       interface{}
+		body      []byte
+		signature string
+		want      string
+	}{
+		{"valid", publicKey, body, base64.StdEncoding.EncodeToString(signature), ""},
+		{"url-safe without padding", publicKey, body, base64.RawURLEncoding.EncodeToString(signature), ""},
+		{"tampered body", publicKey, []byte(`{"ranges": ["0.0.0.0/0"]}`), base64.StdEncoding.EncodeToString(signature), "invalid signature"},
+		{"wrong key", otherKey, body, base64.StdEncoding.EncodeToString(signature), "invalid signature"},
+		{"missing", publicKey, body, " ", "signature missing"},
+		{"invalid encoding", publicKey, body, "not base64!", "invalid signature encoding"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload, err := verifySignedData(SignatureVerification{PublicKey: publicKeyPEM(t, test.key)}, test.body, test.signature)
+			if test.want != "" {
+				if err == nil || !strings.Contains(err.Error(), test.want) {
+					t.Errorf("expected an error containing %q, got %v", test.want, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(payload) != string(body) {
+				t.Errorf("payload %q, want the body", payload)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureFromHeaderAndURL(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"ranges": ["192.0.2.0/24"]}`
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(body)))
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/data":
+			rw.Header().Set("X-Data-Signature", signature)
+			_, _ = rw.Write([]byte(body))
+		case "/data.sig":
+			_, _ = rw.Write([]byte(signature + "\n"))
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	defer server.Close()
+
+	for _, verification := range []SignatureVerification{
+		{PublicKey: publicKeyPEM(t, publicKey), Header: "X-Data-Signature"},
+		{PublicKey: publicKeyPEM(t, publicKey), URL: server.URL + "/data.sig"},
+	} {
+		fetched, err := fetchExternalData(ExternalData{URL: server.URL + "/data", Signature: verification}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(fetched.payload) != body || strings.TrimSpace(fetched.signature) != signature {
+			t.Errorf("got payload %q and signature %q", fetched.payload, fetched.signature)
+		}
+	}
+
+	// The default header is not set by the server
+	_, err = fetchExternalData(ExternalData{URL: server.URL + "/data", Signature: SignatureVerification{PublicKey: publicKeyPEM(t, publicKey)}}, nil)
+	if err == nil || !strings.Contains(err.Error(), "signature missing") {
+		t.Errorf("expected a missing signature, got %v", err)
+	}
+}
+
+func TestVerifyJWS(t *testing.T) {
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := `{"ranges": ["192.0.2.0/24"]}`
+
+	tests := []struct {
+		name  string
+		key   interface{}
+		token string
+		want  string
+	}{
+		{"EdDSA", edPublic, signJWS(t, `{"alg":"EdDSA"}`, payload, edPrivate), ""},
+		{"ES256", &ecPrivate.PublicKey, signJWS(t, `{"alg":"ES256","typ":"JWT"}`, payload, ecPrivate), ""},
+		{"ES256 wrong key", &otherPrivate.PublicKey, signJWS(t, `{"alg":"ES256"}`, payload, ecPrivate), "invalid JWS signature"},
+		{"algorithm of another key type", edPublic, signJWS(t, `{"alg":"ES256"}`, payload, edPrivate), "invalid JWS signature"},
+		{"alg none", edPublic, signJWS(t, `{"alg":"none"}`, payload, edPrivate), "invalid JWS signature (alg none)"},
+		{"unsigned alg none", edPublic, withoutJWSSignature(signJWS(t, `{"alg":"none"}`, payload, edPrivate)), "invalid JWS signature (alg none)"},
+		{"unknown alg", edPublic, signJWS(t, `{"alg":"HS256"}`, payload, edPrivate), "invalid JWS signature (alg HS256)"},
+		{"unknown crit", edPublic, signJWS(t, `{"alg":"EdDSA","crit":["exp"],"exp":1}`, payload, edPrivate), "unsupported critical JWS headers"},
+		{"tampered payload", edPublic, tamperJWSPayload(signJWS(t, `{"alg":"EdDSA"}`, payload, edPrivate)), "invalid JWS signature"},
+		{"two parts", edPublic, "eyJhbGciOiJFZERTQSJ9.e30", "expected 3 parts"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verification := SignatureVerification{PublicKey: publicKeyPEM(t, test.key), Type: SignatureJWS}
+			got, err := verifySignedData(verification, []byte(test.token+"\n"), "")
+			if test.want != "" {
+				if err == nil || !strings.Contains(err.Error(), test.want) {
+					t.Errorf("expected an error containing %q, got %v", test.want, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != payload {
+				t.Errorf("payload %q, want %q", got, payload)
+			}
+		})
+	}
+}
+
+// withoutJWSSignature removes the signature of a JWS.
+func withoutJWSSignature(token string) string {
+	return token[:strings.LastIndex(token, ".")+1]
+}
+
+// tamperJWSPayload replaces the payload of a JWS and keeps its signature.
+func tamperJWSPayload(token string) string {
+	parts := strings.Split(token, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"ranges": ["0.0.0.0/0"]}`))
+	return strings.Join(parts, ".")
+}
+
+func TestCheckSignatureVerification(t *testing.T) {
+	edPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecP384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, config := range []SignatureVerification{
+		{PublicKey: publicKeyPEM(t, edPublic), Type: "pgp"},
+		{PublicKey: "no PEM -----BEGIN"},
+		{PublicKey: publicKeyPEM(t, &ecPrivate.PublicKey)},
+		{PublicKey: publicKeyPEM(t, &ecP384.PublicKey), Type: SignatureJWS},
+	} {
+		if checkSignatureVerification(config) == nil {
+			t.Errorf("expected an error for %+v", config)
+		}
+	}
+	for _, config := range []SignatureVerification{
+		{},
+		{PublicKey: publicKeyPEM(t, edPublic)},
+		{PublicKey: publicKeyPEM(t, &ecPrivate.PublicKey), Type: SignatureJWS},
+	} {
+		if err := checkSignatureVerification(config); err != nil {
+			t.Errorf("unexpected error for %+v: %v", config, err)
+		}
+	}
+}
+
+func TestSignedSourceCache(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `{"ranges": ["192.0.2.0/24"]}`
+	var down int32
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.Header().Set(defaultSignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(body))))
+		_, _ = rw.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	cacheFile := filepath.Join(t.TempDir(), "cache.json")
+	config := &Config{ExternalSources: map[string]ExternalData{
+		"signed": {
+			URL:        server.URL,
+			CacheFile:  cacheFile,
+			Retries:    1,
+			RetryDelay: "1ms",
+			Signature:  SignatureVerification{PublicKey: publicKeyPEM(t, publicKey)},
+		},
+	}}
+	store, err := newExternalDataStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = store.templateData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached envelope is verified again when the source is unavailable
+	atomic.StoreInt32(&down, 1)
+	store, err = newExternalDataStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, err := store.templateData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges, _ := data.(map[string]interface{})["signed"].(map[string]interface{})["ranges"].([]interface{})
+	if len(ranges) != 1 || ranges[0] != "192.0.2.0/24" {
+		t.Fatalf("cached data %v", data)
+	}
+
+	// A tampered cache is not used
+	entry, err := readDataCache(cacheFile, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Body = []byte(`{"ranges": ["0.0.0.0/0"]}`)
+	err = writeDataCache(cacheFile, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err = newExternalDataStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, _ = store.templateData()
+	if data.(map[string]interface{})["signed"] != nil {
+		t.Errorf("tampered cache was used: %v", data)
+	}
+
+	// Without a signature, the cache is rejected as well
+	entry.Body = []byte(body)
+	entry.Signature = ""
+	err = writeDataCache(cacheFile, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err = newExternalDataStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _, _ = store.templateData()
+	if data.(map[string]interface{})["signed"] != nil {
+		t.Errorf("unsigned cache was used: %v", data)
+	}
+}
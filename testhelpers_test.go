@@ -0,0 +1,116 @@
+package tlsguard
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestFile creates a file and its directories for a test.
+func writeTestFile(t *testing.T, filename, content string) {
+	t.Helper()
+	err := os.MkdirAll(filepath.Dir(filename), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filename, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestCert returns a self-signed client certificate. The template can be
+// adjusted before signing.
+func newTestCert(t *testing.T, commonName string, adjust func(*x509.Certificate)) *x509.Certificate {
+	t.Helper()
+	cert, _ := createTestCert(t, commonName, nil, adjust)
+	return cert
+}
+
+// testCA is a certificate authority issuing test certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCA returns a self-signed CA.
+func newTestCA(t *testing.T, commonName string) *testCA {
+	t.Helper()
+	cert, key := createTestCert(t, commonName, nil, func(template *x509.Certificate) {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = nil
+	})
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a certificate signed by the CA and its key.
+func (ca *testCA) issue(t *testing.T, commonName string, adjust func(*x509.Certificate)) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	return createTestCert(t, commonName, ca, adjust)
+}
+
+// pem returns the PEM encoded CA certificate.
+func (ca *testCA) pem() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+}
+
+// createTestCert creates a client certificate signed by the CA, or a
+// self-signed one without CA.
+func createTestCert(t *testing.T, commonName string, ca *testCA, adjust func(*x509.Certificate)) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if adjust != nil {
+		adjust(template)
+	}
+	parent, parentKey := template, key
+	if ca != nil {
+		parent, parentKey = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// withClientCert makes the request arrive over TLS with the client certificate.
+func withClientCert(req *http.Request, cert *x509.Certificate) *http.Request {
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	return req
+}
+
+// headerRecorder is a backend recording the headers of the last request.
+type headerRecorder struct {
+	header http.Header
+}
+
+func (h *headerRecorder) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	h.header = req.Header.Clone()
+	rw.WriteHeader(http.StatusOK)
+}
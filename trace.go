@@ -0,0 +1,126 @@
+package tlsguard
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Headers used to request and return decision traces.
+const (
+	DebugHeader string = "X-TLSGuard-Debug"
+	TraceHeader string = "X-TLSGuard-Trace"
+
+	traceTypeCertificate string = "certificate"
+	traceTypeRefresh     string = "refresh"
+	traceTypeMode        string = "mode"
+)
+
+// TraceEntry records the evaluation of a single rule.
+type TraceEntry struct {
+	Path    string `json:"path"`
+	Type    string `json:"type"`
+	Matched bool   `json:"matched"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Trace explains why a request was allowed or denied.
+type Trace struct {
+	Decision string       `json:"decision"`
+	Reason   string       `json:"reason,omitempty"`
+	Entries  []TraceEntry `json:"entries,omitempty"`
+}
+
+// TracingRule is implemented by rules that can explain their evaluation.
+// A nil trace disables recording.
+type TracingRule interface {
+	MatchTrace(req *http.Request, trace *Trace, path string) bool
+}
+
+// add records a rule evaluation. It is a no-op on a nil trace.
+func (t *Trace) add(path, ruleType string, matched bool, reason string) {
+	if t == nil {
+		return
+	}
+	t.Entries = append(t.Entries, TraceEntry{Path: path, Type: ruleType, Matched: matched, Reason: reason})
+}
+
+// addf records a rule evaluation with a formatted reason. It is a no-op on a nil trace.
+func (t *Trace) addf(path, ruleType string, matched bool, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	t.add(path, ruleType, matched, fmt.Sprintf(format, args...))
+}
+
+// decide records the final decision. It is a no-op on a nil trace.
+func (t *Trace) decide(decision, reason string) {
+	if t == nil {
+		return
+	}
+	t.Decision = decision
+	t.Reason = reason
+}
+
+// String returns the trace as compact JSON.
+func (t *Trace) String() string {
+	if t == nil {
+		return ""
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Sprintf("error encoding trace: %v", err)
+	}
+	return string(data)
+}
+
+// matchRule evaluates a rule and records it in the trace.
+func matchRule(rule Rule, req *http.Request, trace *Trace, path string) bool {
+	if tracingRule, ok := rule.(TracingRule); ok {
+		return tracingRule.MatchTrace(req, trace, path)
+	}
+	matched := rule.Match(req)
+	trace.add(path, fmt.Sprintf("%T", rule), matched, "")
+	return matched
+}
+
+// subPath returns the path of the i-th sub-rule; top-level rules have an empty parent path.
+func (t *Trace) subPath(path string, i int) string {
+	if t == nil {
+		return ""
+	}
+	if path == "" {
+		return fmt.Sprintf("rules[%d]", i)
+	}
+	return fmt.Sprintf("%s.rules[%d]", path, i)
+}
+
+// traceRequested reports whether the request presents the configured debug token.
+func (tg *TLSGuard) traceRequested(req *http.Request) bool {
+	if tg.debugToken == "" {
+		return false
+	}
+	token := strings.TrimSpace(req.Header.Get(DebugHeader))
+	return subtle.ConstantTimeCompare([]byte(token), []byte(tg.debugToken)) == 1
+}
+
+// emitTrace returns the trace to a debugging client and writes it to the decision log.
+func (tg *TLSGuard) emitTrace(rw http.ResponseWriter, req *http.Request, trace *Trace, debug bool) {
+	if trace == nil {
+		return
+	}
+	if debug {
+		rw.Header().Set(TraceHeader, trace.String())
+	}
+	if tg.config.LogDecisions {
+		tg.logDecision(req, trace)
+	}
+}
+
+// logDecision writes the decision and its trace to the log.
+func (tg *TLSGuard) logDecision(req *http.Request, trace *Trace) {
+	fmt.Printf("tlsguard %s: %s %s %s%s from %s: %s\n",
+		tg.name, trace.Decision, req.Method, req.Host, req.URL.Path, clientIP(req), trace)
+}
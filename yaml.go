@@ -0,0 +1,397 @@
+package tlsguard
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a non-empty line of a YAML document without its comment.
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+// parseYAML parses the subset of YAML used by data feeds into the shapes
+// produced by encoding/json: block mappings and sequences, flow collections,
+// plain and quoted scalars and literal (|) and folded (>) block scalars.
+// Anchors, tags and multiple documents are not supported.
+func parseYAML(data []byte) (interface{}, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		// The document end marker ends the data
+		if strings.TrimRight(raw, " ") == "..." {
+			break
+		}
+		trimmed := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("yaml line %d: tabs are not allowed for indentation", i+1)
+		}
+		lines = append(lines, yamlLine{number: i + 1, indent: len(raw) - len(trimmed), text: trimmed})
+	}
+
+	p := &yamlParser{lines: lines}
+	p.skipBlank()
+	if p.pos < len(p.lines) && p.lines[p.pos].text == "---" {
+		p.pos++
+		p.skipBlank()
+	}
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	value, err := p.parseBlock(p.lines[p.pos].indent)
+	if err != nil {
+		return nil, err
+	}
+	p.skipBlank()
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("yaml line %d: unexpected content", p.lines[p.pos].number)
+	}
+	return value, nil
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// skipBlank moves past empty and comment-only lines.
+func (p *yamlParser) skipBlank() {
+	for p.pos < len(p.lines) && stripYAMLComment(p.lines[p.pos].text) == "" {
+		p.pos++
+	}
+}
+
+// current returns the current line without its comment.
+func (p *yamlParser) current() yamlLine {
+	line := p.lines[p.pos]
+	line.text = stripYAMLComment(line.text)
+	return line
+}
+
+// parseBlock parses the mapping or sequence starting at the current line.
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	line := p.current()
+	if line.text == "-" || strings.HasPrefix(line.text, "- ") {
+		return p.parseSequence(indent)
+	}
+	if _, _, ok := splitYAMLKey(line.text); ok {
+		return p.parseMapping(indent)
+	}
+	p.pos++
+	return parseYAMLScalar(line.text, line.number)
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	list := []interface{}{}
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		line := p.current()
+		if line.indent != indent || (line.text != "-" && !strings.HasPrefix(line.text, "- ")) {
+			if line.indent > indent {
+				return nil, fmt.Errorf("yaml line %d: unexpected indentation", line.number)
+			}
+			break
+		}
+
+		item := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if item == "" {
+			p.pos++
+			value, err := p.parseNested(indent)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+			continue
+		}
+
+		// The item continues as a block on the same line, e.g. "- key: value"
+		offset := len(line.text) - len(item)
+		p.lines[p.pos] = yamlLine{number: line.number, indent: indent + offset, text: item}
+		value, err := p.parseBlock(indent + offset)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	object := map[string]interface{}{}
+	for p.skipBlank(); p.pos < len(p.lines); p.skipBlank() {
+		line := p.current()
+		if line.indent != indent {
+			if line.indent > indent {
+				return nil, fmt.Errorf("yaml line %d: unexpected indentation", line.number)
+			}
+			break
+		}
+		key, rest, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, fmt.Errorf("yaml line %d: expected key", line.number)
+		}
+		p.pos++
+
+		var value interface{}
+		var err error
+		switch {
+		case rest == "":
+			value, err = p.parseNested(indent)
+		case rest == "|" || rest == "|-" || rest == ">" || rest == ">-":
+			value = p.parseBlockScalar(indent, rest)
+		default:
+			value, err = parseYAMLScalar(rest, line.number)
+		}
+		if err != nil {
+			return nil, err
+		}
+		object[key] = value
+	}
+	return object, nil
+}
+
+// parseNested parses the block below a key or sequence item. Sequences may
+// start at the indentation of their key.
+func (p *yamlParser) parseNested(indent int) (interface{}, error) {
+	p.skipBlank()
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	line := p.current()
+	if line.indent > indent {
+		return p.parseBlock(line.indent)
+	}
+	if line.indent == indent && (line.text == "-" || strings.HasPrefix(line.text, "- ")) {
+		return p.parseSequence(indent)
+	}
+	return nil, nil
+}
+
+// parseBlockScalar collects the lines of a literal or folded block scalar.
+func (p *yamlParser) parseBlockScalar(indent int, style string) string {
+	var parts []string
+	blockIndent := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		line := p.lines[p.pos]
+		if line.text == "" {
+			parts = append(parts, "")
+			continue
+		}
+		if line.indent <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = line.indent
+		}
+		parts = append(parts, strings.Repeat(" ", line.indent-blockIndent)+line.text)
+	}
+	for len(parts) > 0 && parts[len(parts)-1] == "" {
+		parts = parts[:len(parts)-1]
+	}
+
+	separator := "\n"
+	if strings.HasPrefix(style, ">") {
+		separator = " "
+	}
+	value := strings.Join(parts, separator)
+	if !strings.HasSuffix(style, "-") {
+		value += "\n"
+	}
+	return value
+}
+
+// splitYAMLKey splits "key: value" outside of quotes and flow collections.
+func splitYAMLKey(text string) (string, string, bool) {
+	if text == "" || text[0] == '[' || text[0] == '{' {
+		return "", "", false
+	}
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && i == 0:
+			quote = c
+		case c == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			key := strings.TrimSpace(text[:i])
+			if len(key) >= 2 && (key[0] == '"' || key[0] == '\'') {
+				unquoted, err := parseYAMLScalar(key, 0)
+				if err == nil {
+					key = fmt.Sprint(unquoted)
+				}
+			}
+			return key, strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// stripYAMLComment removes a trailing comment outside of quotes.
+func stripYAMLComment(text string) string {
+	quote := byte(0)
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if (c == '\\' && quote == '"') || (c == '\'' && quote == '\'' && i+1 < len(text) && text[i+1] == '\'') {
+				// Skip the escaped character or quote
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			if i == 0 || strings.ContainsRune(" [{,:-", rune(text[i-1])) {
+				quote = c
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' '):
+			return strings.TrimRight(text[:i], " ")
+		}
+	}
+	return strings.TrimRight(text, " ")
+}
+
+// parseYAMLScalar parses a flow value: quoted or plain scalar, or flow collection.
+func parseYAMLScalar(text string, lineNumber int) (interface{}, error) {
+	text = strings.TrimSpace(text)
+	switch {
+	case text == "":
+		return nil, nil
+	case text[0] == '[' || text[0] == '{':
+		value, rest, err := parseYAMLFlow(text)
+		if err != nil {
+			return nil, fmt.Errorf("yaml line %d: %w", lineNumber, err)
+		}
+		if strings.TrimSpace(rest) != "" {
+			return nil, fmt.Errorf("yaml line %d: unexpected %s", lineNumber, rest)
+		}
+		return value, nil
+	case text[0] == '"':
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("yaml line %d: invalid quoted string %s", lineNumber, text)
+		}
+		return value, nil
+	case text[0] == '\'':
+		if len(text) < 2 || text[len(text)-1] != '\'' {
+			return nil, fmt.Errorf("yaml line %d: invalid quoted string %s", lineNumber, text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	case text[0] == '&' || text[0] == '*' || text[0] == '!':
+		return nil, fmt.Errorf("yaml line %d: anchors, aliases and tags are not supported", lineNumber)
+	}
+
+	switch text {
+	case "null", "Null", "NULL", "~":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if number, err := strconv.ParseFloat(text, 64); err == nil && strings.IndexAny(text, "0123456789") >= 0 &&
+		!strings.ContainsAny(text, "xXpP_") && !strings.EqualFold(text, "inf") && !strings.EqualFold(text, "nan") {
+		return number, nil
+	}
+	return text, nil
+}
+
+// parseYAMLFlow parses a flow sequence or mapping and returns the remaining text.
+func parseYAMLFlow(text string) (interface{}, string, error) {
+	open := text[0]
+	closing := byte(']')
+	if open == '{' {
+		closing = '}'
+	}
+	rest := strings.TrimSpace(text[1:])
+
+	list := []interface{}{}
+	object := map[string]interface{}{}
+	for {
+		if rest == "" {
+			return nil, "", fmt.Errorf("missing %c", closing)
+		}
+		if rest[0] == closing {
+			rest = rest[1:]
+			break
+		}
+
+		var entry string
+		var value interface{}
+		var err error
+		if rest[0] == '[' || rest[0] == '{' {
+			value, rest, err = parseYAMLFlow(rest)
+			if err != nil {
+				return nil, "", err
+			}
+		} else {
+			entry, rest = splitYAMLFlowEntry(rest, closing)
+			if open == '{' {
+				key, valueText, ok := splitYAMLKey(entry)
+				if !ok {
+					return nil, "", fmt.Errorf("expected key in %s", entry)
+				}
+				if strings.HasPrefix(valueText, "[") || strings.HasPrefix(valueText, "{") {
+					value, valueText, err = parseYAMLFlow(valueText)
+					if err == nil && strings.TrimSpace(valueText) != "" {
+						err = fmt.Errorf("unexpected %s", valueText)
+					}
+				} else {
+					value, err = parseYAMLScalar(valueText, 0)
+				}
+				if err != nil {
+					return nil, "", err
+				}
+				object[key] = value
+			} else {
+				value, err = parseYAMLScalar(entry, 0)
+				if err != nil {
+					return nil, "", err
+				}
+			}
+		}
+		if open == '[' {
+			list = append(list, value)
+		}
+
+		rest = strings.TrimSpace(rest)
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		}
+	}
+
+	if open == '{' {
+		return object, rest, nil
+	}
+	return list, rest, nil
+}
+
+// splitYAMLFlowEntry returns the entry up to the next comma or closing bracket
+// outside of quotes and nested collections.
+func splitYAMLFlowEntry(text string, closing byte) (string, string) {
+	quote := byte(0)
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '{':
+			depth++
+		case (c == ']' || c == '}') && depth > 0:
+			depth--
+		case depth == 0 && (c == ',' || c == closing):
+			return strings.TrimSpace(text[:i]), text[i:]
+		}
+	}
+	return strings.TrimSpace(text), ""
+}